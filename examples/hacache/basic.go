@@ -9,6 +9,7 @@ import (
 	"github.com/smira/go-statsd"
 	"github.com/xiachufang/pkg/v2/hacache"
 	"github.com/xiachufang/pkg/v2/hacache/storage"
+	"github.com/xiachufang/pkg/v2/metrics"
 )
 
 // GenerateCacheKey generate cache key
@@ -32,9 +33,10 @@ func main() {
 	statsdClient := statsd.NewClient("localhost:8125")
 
 	// 初始化监控上报连接
-	hacache.CurrentStats.Setup(statsdClient)
+	hacache.CurrentStats.Setup(metrics.NewStatsdSink(statsdClient))
 
 	cache, err := hacache.New(&hacache.Options{
+		Name:                    "long-time-task", // 缓存名称，上报统计数据时作为 name tag
 		FnRunLimit:              10,               // LongTimeTask 同一时刻最多允许 10 个并发穿透到被缓存的原函数
 		MaxAcceptableExpiration: 10 * time.Minute, // 如果命中的缓存过期时间在 10 分钟内，返回缓存值，并异步更新缓存值
 		Expiration:              time.Hour,        // 过期时间 1 小时
@@ -49,6 +51,8 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	// 退出前等待后台的缓存更新完成
+	defer cache.Close(context.Background())
 
 	tom, err := cache.Do(context.Background(), "tom", 10)
 	if err != nil {
@@ -1,12 +1,29 @@
 module github.com/xiachufang/pkg/v2
 
-go 1.14
+go 1.18
 
 require (
+	github.com/bradfitz/gomemcache v0.0.0-20260422231931-4d751bb6e37c
 	github.com/go-redis/redis/v8 v8.0.0-beta.7
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.16.7
 	github.com/pkg/errors v0.8.1
 	github.com/smira/go-statsd v1.3.1
 	github.com/vmihailenco/msgpack/v5 v5.0.0-beta.1
+	go.opentelemetry.io/otel v0.7.0
 	go.uber.org/zap v1.15.0
+	google.golang.org/grpc v1.30.0
 	google.golang.org/protobuf v1.25.0
 )
+
+require (
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200624174652-8d2f3be8b2d9 // indirect
+	github.com/golang/protobuf v1.4.2 // indirect
+	github.com/vmihailenco/tagparser v0.1.1 // indirect
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
+	golang.org/x/exp v0.0.0-20200513190911-00229845015e // indirect
+	golang.org/x/net v0.0.0-20200301022130-244492dfa37a // indirect
+	google.golang.org/appengine v1.6.5 // indirect
+)
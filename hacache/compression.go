@@ -0,0 +1,113 @@
+package hacache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression 缓存值的压缩算法
+type Compression string
+
+const (
+	// CompressionNone 不压缩
+	CompressionNone Compression = ""
+	// CompressionSnappy snappy 压缩，速度快，压缩率较低
+	CompressionSnappy Compression = "snappy"
+	// CompressionZstd zstd 压缩，压缩率与速度比较均衡
+	CompressionZstd Compression = "zstd"
+	// CompressionGzip gzip 压缩
+	CompressionGzip Compression = "gzip"
+)
+
+// defaultCompressionThreshold 默认超过 1KB 的缓存值才压缩
+const defaultCompressionThreshold = 1024
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd 初始化共享的 zstd encoder、decoder，EncodeAll、DecodeAll 可以并发调用
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+// compress 压缩原函数返回值序列化之后的 bytes，返回压缩后的 bytes 以及使用的压缩算法
+// 没有开启压缩、小于阈值或者压缩后没有变小时，返回原始 bytes，压缩算法为空
+func (hc *HaCache) compress(b []byte) ([]byte, Compression, error) {
+	if hc.opt.Compression == CompressionNone || len(b) < hc.opt.CompressionThreshold {
+		return b, CompressionNone, nil
+	}
+
+	compressed, err := compress(hc.opt.Compression, b)
+	if err != nil {
+		return nil, CompressionNone, err
+	}
+	if len(compressed) >= len(b) {
+		return b, CompressionNone, nil
+	}
+	return compressed, hc.opt.Compression, nil
+}
+
+// compress 使用 codec 压缩 b
+func compress(codec Compression, b []byte) ([]byte, error) {
+	switch codec {
+	case CompressionSnappy:
+		return snappy.Encode(nil, b), nil
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(b, nil), nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrorUnknownCompression, codec)
+}
+
+// decompress 按缓存值记录的压缩算法解压，与当前的 Options.Compression 无关，
+// 修改压缩算法后仍然可以读取之前写入的缓存值
+func decompress(codec Compression, b []byte) ([]byte, error) {
+	switch codec {
+	case CompressionNone:
+		return b, nil
+	case CompressionSnappy:
+		return snappy.Decode(nil, b)
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(b, nil)
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrorUnknownCompression, codec)
+}
@@ -0,0 +1,94 @@
+package hacache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Keyring 缓存值 AES-GCM 加密使用的密钥
+type Keyring struct {
+	// Current 加密使用的密钥 ID，不能为空，空 KeyID 的缓存值按未加密处理
+	Current string
+	// Keys 密钥 ID 到密钥的映射，密钥 ID 不能为空，密钥长度为 16、24 或 32 字节，分别对应 AES-128、AES-192、AES-256
+	// 轮换密钥时先加入新密钥并修改 Current，旧密钥保留到使用旧密钥加密的缓存值全部过期
+	Keys map[string][]byte
+}
+
+// keyring 初始化之后的密钥
+type keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// newKeyring 检查密钥并初始化 AES-GCM，k 为 nil 时返回 nil，表示不加密
+func newKeyring(k *Keyring) (*keyring, error) {
+	if k == nil {
+		return nil, nil
+	}
+	if k.Current == "" {
+		return nil, errors.New("current key id is empty")
+	}
+	if _, ok := k.Keys[k.Current]; !ok {
+		return nil, fmt.Errorf("%w: current key %q not found", ErrorUnknownKeyID, k.Current)
+	}
+
+	aeads := make(map[string]cipher.AEAD, len(k.Keys))
+	for id, key := range k.Keys {
+		if id == "" {
+			return nil, errors.New("key id is empty")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		aeads[id] = aead
+	}
+	return &keyring{current: k.Current, aeads: aeads}, nil
+}
+
+// encrypt 使用当前密钥加密，返回 nonce 与密文拼接的 bytes 以及密钥 ID
+// 缓存 key 作为附加数据，密文不能被挪到其他 key 下使用；没有设置 Keyring 时返回原始 bytes
+func (hc *HaCache) encrypt(key string, b []byte) ([]byte, string, error) {
+	if hc.keyring == nil {
+		return b, "", nil
+	}
+
+	aead := hc.keyring.aeads[hc.keyring.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return aead.Seal(nonce, nonce, b, []byte(key)), hc.keyring.current, nil
+}
+
+// decrypt 使用缓存值记录的密钥解密，没有加密的缓存值直接返回
+func (hc *HaCache) decrypt(key string, value *CachedValue) ([]byte, error) {
+	if value.KeyID == "" {
+		return value.Bytes, nil
+	}
+
+	var aead cipher.AEAD
+	if hc.keyring != nil {
+		aead = hc.keyring.aeads[value.KeyID]
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w: %q", ErrorUnknownKeyID, value.KeyID)
+	}
+	if len(value.Bytes) < aead.NonceSize() {
+		return nil, ErrorDecrypt
+	}
+
+	nonce, ciphertext := value.Bytes[:aead.NonceSize()], value.Bytes[aead.NonceSize():]
+	b, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, ErrorDecrypt
+	}
+	return b, nil
+}
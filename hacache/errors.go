@@ -7,4 +7,18 @@ var (
 	ErrorFnRunLimited = errors.New("ha-cache fn run rate limited")
 	// ErrorInvalidCacheKey 无效的缓存 key
 	ErrorInvalidCacheKey = errors.New("invalid cache key")
+	// ErrorCacheClosed ha-cache 已经关闭
+	ErrorCacheClosed = errors.New("ha-cache closed")
+	// ErrorNotFound 原函数返回了不存在的结果
+	ErrorNotFound = errors.New("ha-cache result not found")
+	// ErrorNoBatchFn 没有设置批量执行的原函数
+	ErrorNoBatchFn = errors.New("no batch fn found")
+	// ErrorBatchResultMissing 批量执行的原函数没有返回某个 key 的结果
+	ErrorBatchResultMissing = errors.New("batch fn result missing")
+	// ErrorUnknownCompression 不支持的压缩算法
+	ErrorUnknownCompression = errors.New("ha-cache unknown compression")
+	// ErrorUnknownKeyID 缓存值使用的加密密钥不在 Keyring 中
+	ErrorUnknownKeyID = errors.New("ha-cache unknown encryption key id")
+	// ErrorDecrypt 缓存值解密失败
+	ErrorDecrypt = errors.New("ha-cache decrypt failed")
 )
@@ -1,15 +1,22 @@
 package hacache
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"reflect"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vmihailenco/msgpack/v5"
 	"github.com/xiachufang/pkg/v2/hacache/storage"
 	"github.com/xiachufang/pkg/v2/limiter"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
 	"go.uber.org/zap"
 )
 
@@ -22,14 +29,20 @@ type Event interface{}
 // EventCacheExpired 缓存过期，但是可以接受，需要执行原始函数进行更新
 type EventCacheExpired struct {
 	Args []interface{}
+	// Key 缓存 key，为空时根据 Args 生成
+	Key string
+	// SpanContext 触发更新的请求的 span，后台更新的 span 链接到该 span
+	SpanContext trace.SpanContext
 }
 
 // EventCacheInvalid 缓存无效，需要立即更新
 type EventCacheInvalid struct {
-	// Bytes 原始函数返回的结果，需要放到缓存里
-	Data interface{}
+	// Result 原始函数返回的结果，需要放到缓存里
+	Result *FnResult
 	// Key 缓存 key
 	Key string
+	// SpanContext 触发更新的请求的 span，后台更新的 span 链接到该 span
+	SpanContext trace.SpanContext
 }
 
 // HaCache ha-cache struct
@@ -37,8 +50,35 @@ type HaCache struct {
 	// fnRunLimiter 被缓存的原函数执行并发限制
 	fnRunLimiter *limiter.Limiter
 	opt          *Options
-	events       chan Event
-	logger       *zap.Logger
+	// events 每个 worker 一个 event channel，同一个 key 的 event 总是由同一个 worker 处理
+	events []chan Event
+	// queued 已经触发还没有被 worker 取出的 event 数量
+	queued int32
+	logger *zap.Logger
+	// stats 当前实例的统计数据
+	stats *Stats
+	// fn 被缓存的原函数，New 通过反射包装 Options.Fn，NewTyped 直接包装泛型函数
+	fn func(ctx context.Context, args []interface{}) (*FnResult, error)
+	// genKey 生成缓存 key 的函数
+	genKey func(ctx context.Context, args []interface{}) string
+	// flight 合并同一个 key 并发的同步更新
+	flight flightGroup
+	// l1 进程内缓存，没有开启时为 nil
+	l1 *l1Cache
+	// keyring 缓存值加密使用的密钥，没有开启时为 nil
+	keyring *keyring
+	// unsubscribe 取消订阅失效广播，没有订阅时为 nil
+	unsubscribe func() error
+
+	// mu 保护 events 的发送与关闭
+	mu sync.RWMutex
+	// closed 是否已经关闭，关闭后不再接收新的 event，Do 直接返回 ErrorCacheClosed
+	closed int32
+	// done 所有 worker 处理完 event 后关闭
+	done chan struct{}
+	// ctx 后台更新使用的 context，Close 超时后取消，放弃未完成的更新
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // CachedValue 缓存值类型
@@ -47,6 +87,25 @@ type CachedValue struct {
 	Bytes []byte
 	// 缓存创建的时间戳/s
 	CreateTS int64
+	// 缓存关联的 tag，及写入缓存时 tag 的版本
+	Tags map[string]int64
+	// 原函数执行耗时/ms，用于提前刷新
+	Delta int64
+	// 缓存有效期/ms，为 0 时使用 Options.Expiration
+	Expiration int64
+	// 最大可接受的过期时间/ms，为 0 时使用 Options.MaxAcceptableExpiration
+	MaxStale int64
+	// 负缓存：原函数返回了不存在的结果
+	NotFound bool
+	// 负缓存：原函数返回的 error 信息
+	Err string
+	// Bytes 使用的压缩算法，为空时没有压缩
+	Compression Compression
+	// Bytes 加密使用的密钥 ID，为空时没有加密
+	KeyID string
+
+	// inL1 缓存值从 L1 中读取
+	inL1 bool
 }
 
 // FnResult 被缓存函数返回值的通用结构
@@ -57,6 +116,34 @@ type FnResult struct {
 	Err error
 	// Ignore 忽略返回值，不设置回缓存
 	Ignore bool
+	// NotFound 结果不存在，开启负缓存（Options.NegativeExpiration）时写入缓存，Do 返回 ErrorNotFound
+	NotFound bool
+	// Tags 缓存关联的 tag，InvalidateTag 后所有关联该 tag 的缓存都会失效
+	Tags []string
+	// Expiration 缓存有效期，为 0 时使用 Options.Expiration，同样按 Options.ExpirationJitter 浮动
+	Expiration time.Duration
+	// MaxStale 最大可接受的过期时间，为 0 时使用 Options.MaxAcceptableExpiration
+	MaxStale time.Duration
+
+	// cost 原函数执行耗时，由 FnRun 记录
+	cost time.Duration
+	// start 原函数开始执行的时间，由 FnRun 记录
+	start time.Time
+	// meta 写入缓存时使用的有效期和 tag 版本，为 nil 时由 SetResult 确定
+	meta *entryMeta
+}
+
+// entryMeta 写入缓存值前确定的有效期和 tag 版本，同步更新时在执行原函数的 goroutine 中确定，
+// 后台 worker 写入时不再读取 Options 和 tag 版本
+type entryMeta struct {
+	// expiration、maxStale 记录在缓存值中，只在原函数返回值覆盖或者有效期浮动时不为 0，
+	// 为 0 时读取缓存值使用 Options 的当前值
+	expiration time.Duration
+	maxStale   time.Duration
+	// ttl 缓存值在 storage 中的过期时间
+	ttl time.Duration
+	// tags 结果关联的 tag 版本
+	tags map[string]int64
 }
 
 // New return a new ha-cache instance
@@ -75,214 +162,717 @@ func New(opt *Options) (*HaCache, error) {
 		return nil, errors.New("fn return value must be `*hacache.FnResult`")
 	}
 
+	fn := func(ctx context.Context, args []interface{}) (*FnResult, error) {
+		result, err := call(opt.Fn, ctx, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		if v, ok := result[0].Interface().(*FnResult); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("fnResult type convert error")
+	}
+
+	genKey := func(ctx context.Context, args []interface{}) string {
+		result, err := call(opt.GenKeyFn, ctx, args...)
+		if err != nil {
+			return ""
+		}
+
+		// 生成缓存 key 的函数只有一个 string 返回值
+		if len(result) != 1 {
+			return ""
+		}
+
+		if key, ok := result[0].Interface().(string); ok {
+			return key
+		}
+		return ""
+	}
+
+	return newHaCache(opt, fn, genKey)
+}
+
+// newHaCache 初始化 ha-cache 实例，并启动后台 worker
+func newHaCache(
+	opt *Options,
+	fn func(ctx context.Context, args []interface{}) (*FnResult, error),
+	genKey func(ctx context.Context, args []interface{}) string,
+) (*HaCache, error) {
+	keyring, err := newKeyring(opt.Keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stats := NewStats(opt.Name)
 	hc := &HaCache{
-		fnRunLimiter: limiter.New(opt.FnRunLimit),
+		fnRunLimiter: limiter.NewWithSink(opt.FnRunLimit, stats.Name, limiterSink{stats}),
 		opt:          opt,
-		events:       make(chan Event, opt.EventBufferSize),
+		events:       make([]chan Event, opt.Workers),
 		logger:       opt.Logger,
+		stats:        stats,
+		fn:           fn,
+		genKey:       genKey,
+		l1:           newL1Cache(opt.L1Size, opt.L1TTL),
+		keyring:      keyring,
+		done:         make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+
+	CurrentStats.register(hc.stats)
+	if opt.MetricsSink != nil {
+		hc.stats.Setup(opt.MetricsSink)
 	}
-	go hc.worker()
+	hc.subscribeInvalidation()
+
+	var wg sync.WaitGroup
+	wg.Add(len(hc.events))
+	for i := range hc.events {
+		hc.events[i] = make(chan Event, opt.EventBufferSize)
+		go func(events chan Event) {
+			defer wg.Done()
+			hc.worker(events)
+		}(hc.events[i])
+	}
+	go func() {
+		wg.Wait()
+		close(hc.done)
+	}()
 	return hc, nil
 }
 
-// worker 刷新缓存、更新过期缓存
-func (hc *HaCache) worker() {
+// worker 刷新缓存、更新过期缓存，events 关闭并处理完后退出
+func (hc *HaCache) worker(events chan Event) {
+	for event := range events {
+		hc.stats.Gauge(GMEventQueueDepth, atomic.AddInt32(&hc.queued, -1))
+		hc.handle(event)
+	}
+}
+
+// handle 处理单个 event
+func (hc *HaCache) handle(event Event) {
 	defer func() {
 		if v := recover(); v != nil {
-			CurrentStats.Incr(MWorkerPanic, 1)
+			hc.stats.Incr(MWorkerPanic, 1)
 			hc.logger.Error(fmt.Sprintf("hacache worker paniced: %v, stack: %s", v, string(debug.Stack())))
-			hc.worker()
 		}
 	}()
 
-	for {
-		event := <-hc.events
-		switch e := event.(type) {
-		case *EventCacheExpired:
-			data, err := hc.FnRun(true, e.Args...)
-			if err != nil || (data != nil && (data.Err != nil || data.Ignore)) {
-				continue
-			}
-			if err := hc.Set(hc.GenCacheKey(e.Args...), data.Val); err != nil {
-				continue
-			}
-		case *EventCacheInvalid:
-			if err := hc.Set(e.Key, e.Data); err != nil {
-				continue
-			}
+	// 后台更新与触发请求的生命周期无关，使用独立的 context
+	ctx := hc.ctx
+	switch e := event.(type) {
+	case *EventCacheExpired:
+		key := e.Key
+		if key == "" {
+			key = hc.GenCacheKey(ctx, e.Args...)
+		}
+		ctx, span := hc.startRefreshSpan(ctx, key, e.SpanContext)
+		defer span.End()
+
+		// 其他实例持有租约，由其他实例更新
+		token, ok := hc.acquireRefreshLease(ctx, key)
+		if !ok {
+			span.SetAttributes(kv.String(attrKeyOutcome, string(MRefreshLeaseSkipped)))
+			return
+		}
+		// 更新结束后立即释放租约，不阻塞下一次过期时的更新
+		defer hc.releaseRefreshLease(ctx, key, token)
+
+		// 触发限流时 data 为 nil
+		data, err := hc.FnRun(ctx, true, e.Args...)
+		if err != nil || data == nil || !hc.cacheable(data) {
+			return
 		}
+		_ = hc.SetResult(ctx, key, data)
+	case *EventCacheInvalid:
+		ctx, span := hc.startRefreshSpan(ctx, e.Key, e.SpanContext)
+		defer span.End()
+
+		_ = hc.SetResult(ctx, e.Key, e.Result)
 	}
 }
 
+// Close 关闭 ha-cache，不再接收新的 event，并等待已经触发的缓存更新处理完
+// ctx 超时后取消未完成的更新，返回 ctx.Err()；关闭后 Do 返回 ErrorCacheClosed
+func (hc *HaCache) Close(ctx context.Context) error {
+	hc.mu.Lock()
+	if atomic.CompareAndSwapInt32(&hc.closed, 0, 1) {
+		for _, events := range hc.events {
+			close(events)
+		}
+		hc.unsubscribeInvalidation()
+	}
+	hc.mu.Unlock()
+
+	// 等待队列处理完之后上报最后一次数据，再从汇总统计中移除
+	defer func() {
+		hc.stats.Stop()
+		CurrentStats.unregister(hc.stats)
+	}()
+	select {
+	case <-hc.done:
+		hc.cancel()
+		return nil
+	case <-ctx.Done():
+		hc.cancel()
+		return ctx.Err()
+	}
+}
+
+// Stats 当前实例的统计数据
+func (hc *HaCache) Stats() *Stats {
+	return hc.stats
+}
+
+// isClosed 是否已经关闭
+func (hc *HaCache) isClosed() bool {
+	return atomic.LoadInt32(&hc.closed) == 1
+}
+
 // FnRun 执行原函数，原函数执行时，受并发限制，
 // 如果是缓存过期异步更新，触发限流直接跳过；
 // 如果是缓存失效同步更新，触发限流服务报错
-// 被缓存的函数签名为: func(args ...interface{}) (*FnResult)
-func (hc *HaCache) FnRun(background bool, args ...interface{}) (*FnResult, error) {
-	CurrentStats.Incr(MFnRun, 1)
-	_, ok := hc.fnRunLimiter.Incr(1)
-	defer hc.fnRunLimiter.Decr(1)
+// 被缓存的函数签名为: func(args ...interface{}) (*FnResult)，第一个参数为 context.Context 时传入 ctx
+// ctx 取消时不再等待原函数返回，原函数执行结束后才释放并发限制
+func (hc *HaCache) FnRun(ctx context.Context, background bool, args ...interface{}) (res *FnResult, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	// 统计当前原函数执行的并发度
-	CurrentStats.Gauge(GMFnRunConcurrency, hc.fnRunLimiter.GetCurrent())
+	ctx, span := hc.startSpan(ctx, spanFnRun, kv.Bool(attrKeyBackground, background))
+	defer func() { endSpan(ctx, span, err) }()
 
-	if !ok {
-		CurrentStats.Incr(MFnRunLimited, 1)
-	}
+	ok := hc.acquireFnRun()
 
 	// 异步更新的直接跳过，需要同步更新的返回报错
+	if !ok {
+		hc.releaseFnRun()
+		span.SetAttributes(kv.String(attrKeyOutcome, outcomeLimited))
+	}
 	if !ok && background {
 		return nil, nil
 	} else if !ok && !background {
 		return nil, ErrorFnRunLimited
 	}
 
-	result, err := call(hc.opt.Fn, args...)
-	if err != nil {
-		return nil, err
+	start := time.Now()
+	// ctx 取消后调用方不再等待，但原函数仍在执行，执行结束时才释放并发额度
+	res, err = runWithContext(ctx, hc.logger, func() (*FnResult, error) {
+		defer hc.releaseFnRun()
+		return hc.fn(ctx, args)
+	})
+	if err != nil || res == nil {
+		return res, err
 	}
+	recordError(ctx, span, res.Err)
+	cost := time.Since(start)
+	hc.stats.Timing(TMFnRun, cost)
+
+	// 拷贝一份再记录耗时，原函数可能返回共享的 *FnResult
+	copied := *res
+	copied.cost = cost
+	copied.start = start
+	return &copied, nil
+}
+
+// acquireFnRun 占用一个原函数执行的并发额度，返回 false 说明触发了限流
+// 无论是否触发限流都需要调用 releaseFnRun 释放，原函数执行结束之后才能释放
+func (hc *HaCache) acquireFnRun() bool {
+	hc.stats.Incr(MFnRun, 1)
+	_, ok := hc.fnRunLimiter.Incr(1)
+
+	// 统计当前原函数执行的并发度
+	hc.stats.Gauge(GMFnRunConcurrency, hc.fnRunLimiter.GetCurrent())
 
-	v, ok := result[0].Interface().(*FnResult)
-	if ok {
-		return v, nil
+	if !ok {
+		hc.stats.Incr(MFnRunLimited, 1)
 	}
+	return ok
+}
 
-	return nil, fmt.Errorf("fnResult type convert error")
+// releaseFnRun 释放原函数执行并发额度
+func (hc *HaCache) releaseFnRun() {
+	hc.fnRunLimiter.Decr(1)
+	hc.stats.Gauge(GMFnRunConcurrency, hc.fnRunLimiter.GetCurrent())
 }
 
-// GenCacheKey 生成缓存 key
-func (hc *HaCache) GenCacheKey(args ...interface{}) string {
-	result, err := call(hc.opt.GenKeyFn, args...)
+// load 同步执行原函数，并触发缓存更新
+// 同一个 key 并发的调用会合并为一次原函数执行，其他调用者等待执行结果
+func (hc *HaCache) load(ctx context.Context, cacheKey string, args []interface{}) (*FnResult, error) {
+	res, shared, err := hc.flight.Do(ctx, cacheKey, func(ctx context.Context) (*FnResult, error) {
+		res, err := hc.FnRun(ctx, false, args...)
+		if err == nil && hc.cacheable(res) {
+			copied := copyResult(res)
+			if copied.meta, err = hc.newEntryMeta(ctx, copied); err != nil {
+				hc.logger.Warn(fmt.Sprintf("read tag versions of %s error: %s", cacheKey, err))
+				return res, nil
+			}
+			hc.Trigger(&EventCacheInvalid{
+				Result:      copied,
+				Key:         cacheKey,
+				SpanContext: spanContext(ctx),
+			})
+		}
+		return res, err
+	})
+	if shared {
+		hc.stats.Incr(MFnRunCoalesced, 1)
+	}
 	if err != nil {
-		return ""
+		return nil, err
 	}
 
-	// 生成缓存 key 的函数只有一个 string 返回值
-	if len(result) != 1 {
-		return ""
+	if shared {
+		// 合并的调用者各自拿到一份拷贝，避免共享同一个返回值
+		res = copyResult(res)
+	}
+	return res, nil
+}
+
+// loadValue 缓存 miss 时同步执行原函数，返回原函数的执行结果
+func (hc *HaCache) loadValue(ctx context.Context, cacheKey string, args []interface{}) (interface{}, error) {
+	res, err := hc.load(ctx, cacheKey, args)
+	if err != nil {
+		hc.stats.Incr(MFnRunErr, 1)
+		return nil, err
 	}
+	if res.Err != nil {
+		hc.stats.Incr(MFnRunErr, 1)
+	}
+	return resultValue(res)
+}
 
-	if key, ok := result[0].Interface().(string); ok {
-		return key
+// undecodable 缓存值是否因为未知的密钥、压缩算法或者解密失败无法读取
+// 滚动轮换密钥时，还没有新密钥的实例会读到新密钥写入的缓存值，按缓存 miss 处理，执行原函数覆盖缓存
+func (hc *HaCache) undecodable(err error) bool {
+	if errors.Is(err, ErrorUnknownKeyID) || errors.Is(err, ErrorDecrypt) || errors.Is(err, ErrorUnknownCompression) {
+		hc.stats.Incr(MUndecodable, 1)
+		return true
 	}
+	return false
+}
 
-	return ""
+// GenCacheKey 生成缓存 key
+func (hc *HaCache) GenCacheKey(ctx context.Context, args ...interface{}) string {
+	return hc.genKey(ctx, args)
 }
 
 // Get get cached value
-func (hc *HaCache) Get(key string) (*CachedValue, error) {
-	b, err := hc.opt.Storage.Get(key)
+func (hc *HaCache) Get(ctx context.Context, key string) (*CachedValue, error) {
+	ctx, span := hc.startSpan(ctx, spanStorageGet, kv.String(attrKeyKey, key))
+	defer span.End()
+
+	start := time.Now()
+	b, err := hc.opt.Storage.Get(ctx, key)
+	hc.timing(TMStorageGet, start)
+	if err == storage.ErrorCacheMiss {
+		span.SetAttributes(kv.String(attrKeyOutcome, string(MMiss)))
+		return nil, err
+	}
 	if err != nil {
+		recordError(ctx, span, err)
 		return nil, err
 	}
 
+	value, err := decodeCachedValue(b)
+	recordError(ctx, span, err)
+	return value, err
+}
+
+// decode 解密、解压并反序列化 key 对应的缓存值
+func (hc *HaCache) decode(ctx context.Context, key string, value *CachedValue) (v interface{}, err error) {
+	ctx, span := hc.startSpan(ctx, spanDecode)
+	defer func() { endSpan(ctx, span, err) }()
+	defer hc.timing(TMDecode, time.Now())
+
+	b, err := hc.decrypt(key, value)
+	if err != nil {
+		return nil, err
+	}
+	b, err = decompress(value.Compression, b)
+	if err != nil {
+		return nil, err
+	}
+	return hc.opt.Encoder.Decode(b)
+}
+
+// storageSet 写入 storage
+func (hc *HaCache) storageSet(ctx context.Context, key string, value []byte, expiration time.Duration) (err error) {
+	ctx, span := hc.startSpan(ctx, spanStorageSet, kv.String(attrKeyKey, key))
+	defer func() { endSpan(ctx, span, err) }()
+	defer hc.timing(TMStorageSet, time.Now())
+
+	return hc.opt.Storage.Set(ctx, key, value, expiration)
+}
+
+// decodeCachedValue 反序列化 storage 中的缓存值
+func decodeCachedValue(b []byte) (*CachedValue, error) {
 	v := new(CachedValue)
-	err = msgpack.Unmarshal(b, v)
+	err := msgpack.Unmarshal(b, v)
 	return v, err
 }
 
 // Set set `key` to `msg`
-func (hc *HaCache) Set(key string, data interface{}) error {
+func (hc *HaCache) Set(ctx context.Context, key string, data interface{}) error {
+	return hc.SetResult(ctx, key, &FnResult{Val: data})
+}
+
+// SetResult 将原函数的执行结果写入缓存，会记录结果关联的 tag 的版本
+// 不存在的结果以及原函数返回的 error 写入负缓存，过期时间为 NegativeExpiration
+func (hc *HaCache) SetResult(ctx context.Context, key string, res *FnResult) error {
+	if res.NotFound || res.Err != nil {
+		return hc.setNegative(ctx, key, res)
+	}
+
 	// protobuf message 用 protobuf 序列化
 	// 带上 create time 时间戳的 struct 用 msgpack 序列化
-	b, err := hc.opt.Encoder.Encode(data)
+	start := time.Now()
+	b, err := hc.opt.Encoder.Encode(res.Val)
+	if err != nil {
+		return err
+	}
+	b, compression, err := hc.compress(b)
+	if err != nil {
+		return err
+	}
+	b, keyID, err := hc.encrypt(key, b)
+	hc.timing(TMEncode, start)
 	if err != nil {
 		return err
 	}
 
-	value, err := msgpack.Marshal(CachedValue{
-		Bytes:    b,
-		CreateTS: time.Now().Unix(),
-	})
+	meta := res.meta
+	if meta == nil {
+		if meta, err = hc.newEntryMeta(ctx, res); err != nil {
+			return err
+		}
+	}
+
+	cv := CachedValue{
+		Bytes:       b,
+		CreateTS:    time.Now().Unix(),
+		Tags:        meta.tags,
+		Delta:       res.cost.Milliseconds(),
+		Expiration:  meta.expiration.Milliseconds(),
+		MaxStale:    meta.maxStale.Milliseconds(),
+		Compression: compression,
+		KeyID:       keyID,
+	}
+	value, err := msgpack.Marshal(cv)
 	if err != nil {
 		return err
 	}
-	return hc.opt.Storage.Set(key, value, hc.opt.Expiration + hc.opt.MaxAcceptableExpiration)
+	if err := hc.storageSet(ctx, key, value, meta.ttl); err != nil {
+		return err
+	}
+	hc.setL1(key, &cv)
+	return nil
+}
+
+// setNegative 写入负缓存，负缓存没有可接受的过期时间
+func (hc *HaCache) setNegative(ctx context.Context, key string, res *FnResult) error {
+	cv := CachedValue{
+		CreateTS:   time.Now().Unix(),
+		Expiration: hc.opt.NegativeExpiration.Milliseconds(),
+		NotFound:   res.Err == nil,
+	}
+	if res.Err != nil {
+		cv.Err = res.Err.Error()
+	}
+
+	value, err := msgpack.Marshal(cv)
+	if err != nil {
+		return err
+	}
+	if err := hc.storageSet(ctx, key, value, hc.opt.NegativeExpiration); err != nil {
+		return err
+	}
+	hc.setL1(key, &cv)
+	return nil
+}
+
+// newEntryMeta 确定原函数执行结果写入缓存时的有效期
+// 原函数开始执行之后 tag 被失效过的，记录为 invalidTagVersion，写入的缓存值读取时按 tag 失效处理
+func (hc *HaCache) newEntryMeta(ctx context.Context, res *FnResult) (*entryMeta, error) {
+	tags, err := hc.tagVersions(ctx, res.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if !res.start.IsZero() {
+		for tag, version := range tags {
+			if version >= res.start.UnixNano() {
+				tags[tag] = invalidTagVersion
+			}
+		}
+	}
+
+	meta := &entryMeta{tags: tags}
+	expiration := hc.opt.Expiration
+	if res.Expiration > 0 {
+		expiration = res.Expiration
+		meta.expiration = expiration
+	}
+	if jittered := hc.jitter(expiration); jittered != expiration {
+		expiration = jittered
+		meta.expiration = expiration
+	}
+
+	maxStale := hc.opt.MaxAcceptableExpiration
+	if res.MaxStale > 0 {
+		maxStale = res.MaxStale
+		meta.maxStale = maxStale
+	}
+	meta.ttl = expiration + maxStale
+	return meta, nil
+}
+
+// jitter 新写入缓存的有效期，设置了 ExpirationJitter 时在 expiration 上下随机浮动
+func (hc *HaCache) jitter(expiration time.Duration) time.Duration {
+	if hc.opt.ExpirationJitter > 0 {
+		// 浮动范围 [-jitter, +jitter)
+		jitter := (rand.Float64()*2 - 1) * hc.opt.ExpirationJitter
+		expiration += time.Duration(float64(expiration) * jitter)
+	}
+	return expiration
+}
+
+// cacheState 缓存值的状态
+type cacheState int
+
+const (
+	// stateFresh 缓存值在有效期内
+	stateFresh cacheState = iota
+	// stateEarlyRefresh 缓存值在有效期内，但是需要提前刷新
+	stateEarlyRefresh
+	// stateExpired 缓存过期，但是在可接受的过期范围内
+	stateExpired
+	// stateInvalid 缓存过期已经超过了最大可接受时间
+	stateInvalid
+)
+
+// state 判断缓存值在 now 时刻的状态
+func (hc *HaCache) state(value *CachedValue, now time.Time) cacheState {
+	expiration := hc.opt.Expiration
+	if value.Expiration > 0 {
+		expiration = time.Duration(value.Expiration) * time.Millisecond
+	}
+
+	maxStale := hc.opt.MaxAcceptableExpiration
+	if value.MaxStale > 0 {
+		maxStale = time.Duration(value.MaxStale) * time.Millisecond
+	}
+
+	expireAt := value.CreateTS + int64(expiration.Seconds())
+	switch {
+	case expireAt >= now.Unix():
+		if hc.earlyRefresh(value, expireAt, now) {
+			return stateEarlyRefresh
+		}
+		return stateFresh
+	case now.Unix() > expireAt+int64(maxStale.Seconds()):
+		return stateInvalid
+	default:
+		return stateExpired
+	}
 }
 
-// Trigger 触发某个 event (non-blocking)
+// earlyRefresh 概率性提前刷新（XFetch），避免同时写入的缓存同时过期
+// 越接近过期时间、原函数执行耗时越长，提前刷新的概率越大：
+// delta * beta * -ln(rand) >= expireAt - now
+func (hc *HaCache) earlyRefresh(value *CachedValue, expireAt int64, now time.Time) bool {
+	if hc.opt.EarlyRefreshBeta <= 0 || value.Delta <= 0 {
+		return false
+	}
+
+	delta := time.Duration(value.Delta) * time.Millisecond
+	gap := time.Unix(expireAt, 0).Sub(now)
+	// 1 - rand.Float64() 的取值范围为 (0, 1]
+	return delta.Seconds()*hc.opt.EarlyRefreshBeta*-math.Log(1-rand.Float64()) >= gap.Seconds()
+}
+
+// Delete 删除缓存，数据更新后可以立即淘汰旧的缓存，而不必等待缓存过期
+// 设置了 InvalidationBus 时同时通知其他实例删除 L1 中的缓存值
+func (hc *HaCache) Delete(ctx context.Context, key string) error {
+	hc.l1.delete(key)
+	if err := hc.opt.Storage.Delete(ctx, key); err != nil {
+		return err
+	}
+	hc.publishInvalidation(ctx, key)
+	return nil
+}
+
+// Invalidate 删除 args 对应的缓存，args 与 Do 的参数一致
+func (hc *HaCache) Invalidate(ctx context.Context, args ...interface{}) error {
+	key := hc.GenCacheKey(ctx, args...)
+	switch key {
+	case "":
+		return ErrorInvalidCacheKey
+	case SkipCache:
+		return nil
+	}
+	return hc.Delete(ctx, key)
+}
+
+// Trigger 触发某个 event (non-blocking)，关闭后触发的 event 直接丢弃
 func (hc *HaCache) Trigger(event Event) {
-	select {
-	case hc.events <- event:
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	if hc.isClosed() {
 		return
+	}
+
+	// 同一个 key 的 event 发送到同一个 worker，保证处理顺序
+	events := hc.events[0]
+	if len(hc.events) > 1 {
+		events = hc.events[shard(eventKey(event), len(hc.events))]
+	}
+
+	// 先计数再发送，避免 worker 先取出 event 导致计数为负
+	queued := atomic.AddInt32(&hc.queued, 1)
+	select {
+	case events <- event:
+		hc.stats.Gauge(GMEventQueueDepth, queued)
 	default:
-		CurrentStats.Incr(MEventChanBlocked, 1)
+		atomic.AddInt32(&hc.queued, -1)
+		hc.stats.Incr(MEventChanBlocked, 1)
 	}
 }
 
+// eventKey 获取 event 对应的缓存 key
+func eventKey(event Event) string {
+	switch e := event.(type) {
+	case *EventCacheExpired:
+		return e.Key
+	case *EventCacheInvalid:
+		return e.Key
+	}
+	return ""
+}
+
 // Do 取缓存结果，如果不存在，则更新缓存
-func (hc *HaCache) Do(args ...interface{}) (interface{}, error) {
-	cacheKey := hc.GenCacheKey(args...)
+// ctx 会传递给 Storage 以及第一个参数为 context.Context 的原函数、key 生成函数，
+// ctx 取消或超时后，不再等待 Storage 和原函数，直接返回 ctx.Err()
+func (hc *HaCache) Do(ctx context.Context, args ...interface{}) (v interface{}, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if hc.isClosed() {
+		return nil, ErrorCacheClosed
+	}
+
+	ctx, span := hc.startSpan(ctx, spanDo)
+	defer func() {
+		if err == ErrorFnRunLimited {
+			span.SetAttributes(kv.String(attrKeyOutcome, outcomeLimited))
+		}
+		endSpan(ctx, span, err)
+	}()
+
+	cacheKey := hc.GenCacheKey(ctx, args...)
+	span.SetAttributes(kv.String(attrKeyKey, cacheKey))
 	if cacheKey == "" {
 		return nil, ErrorInvalidCacheKey
 	} else if cacheKey == SkipCache {
-		CurrentStats.Incr(MSkip, 1)
-		res, err := hc.FnRun(false, args...)
+		hc.outcome(span, MSkip)
+		res, err := hc.FnRun(ctx, false, args...)
 		if err != nil {
 			return nil, err
 		}
+		if res.NotFound && res.Err == nil {
+			return nil, ErrorNotFound
+		}
 		return res.Val, res.Err
 	}
 
-	value, err := hc.Get(cacheKey)
+	value, state, err := hc.lookup(ctx, cacheKey)
+	if err == nil {
+		// 负缓存没有可接受的过期时间，过期后按缓存 miss 处理
+		if value.negative() && state != stateFresh && state != stateEarlyRefresh {
+			err = storage.ErrorCacheMiss
+		}
+	}
+
 	// 这里取缓存出错，一般可认为是没取到缓存，极端情况可能是 Redis 异常，直接穿透到原函数返回，并刷新缓存
 	// 原函数执行受 FnRunLimiter 并发限制
 	if err == storage.ErrorCacheMiss {
-		CurrentStats.Incr(MMiss, 1)
+		hc.outcome(span, MMiss)
+	} else if err != nil {
+		span.SetAttributes(kv.String(attrKeyOutcome, string(MMiss)))
 	}
 
 	// 缓存 miss，执行原函数
 	if err != nil {
-		res, err := hc.FnRun(false, args...)
-		if err != nil || res.Err != nil {
-			CurrentStats.Incr(MFnRunErr, 1)
-			return nil, err
-		}
+		return hc.loadValue(ctx, cacheKey, args)
+	}
 
-		if !res.Ignore {
-			hc.Trigger(&EventCacheInvalid{
-				Data: res.Val,
-				Key:  cacheKey,
-			})
-		}
-		return res.Val, nil
+	// 命中负缓存，直接返回不存在或者缓存的 error
+	if value.negative() {
+		hc.outcome(span, MNegativeHit)
+		return nil, value.negativeErr()
 	}
 
-	expireAt := value.CreateTS + int64(hc.opt.Expiration.Seconds())
-	now := time.Now().Unix()
+	// 关联的 tag 已经失效，与超过最大可接受过期时间的缓存一样处理
+	if state != stateInvalid && len(value.Tags) > 0 && !hc.checkTags(ctx, []*CachedValue{value})[0] {
+		hc.stats.Incr(MTagInvalid, 1)
+		state = stateInvalid
+	}
 
 	// 缓存值在有效期内
-	if expireAt >= now {
-		CurrentStats.Incr(MHit, 1)
-		return hc.opt.Encoder.Decode(value.Bytes)
+	if state == stateFresh {
+		hc.outcome(span, MHit)
+		hc.staleness(value)
+		v, err = hc.decodeValue(ctx, cacheKey, value, state)
+		if hc.undecodable(err) {
+			return hc.loadValue(ctx, cacheKey, args)
+		}
+		return v, err
 	}
 
 	// 缓存过期已经超过了最大可接受时间，需要同步更新缓存，并返回最新内容
-	if now > (expireAt + int64(hc.opt.MaxAcceptableExpiration.Seconds())) {
-		CurrentStats.Incr(MMissInvalid, 1)
-		res, err := hc.FnRun(false, args...)
+	if state == stateInvalid {
+		hc.outcome(span, MMissInvalid)
+		res, err := hc.load(ctx, cacheKey, args)
+		// 请求已经取消，不需要再返回过期数据
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
 		// 触发限流、或者原函数执行错误，强制返回过期数据，并且跳过缓存更新步骤
+		// 过期数据无法解密或者解压时返回原函数的错误
 		if err != nil || res.Err != nil {
-			CurrentStats.Incr(MInvalidReturned, 1)
-			return hc.opt.Encoder.Decode(value.Bytes)
-		}
-
-		if !res.Ignore {
-			hc.Trigger(&EventCacheInvalid{
-				Data: copyVal(res.Val),
-				Key:  cacheKey,
-			})
+			v, decodeErr := hc.decode(ctx, cacheKey, value)
+			if !hc.undecodable(decodeErr) {
+				hc.stats.Incr(MInvalidReturned, 1)
+				hc.staleness(value)
+				return v, decodeErr
+			}
+			hc.stats.Incr(MFnRunErr, 1)
+			if err != nil {
+				return nil, err
+			}
 		}
-
-		return res.Val, nil
+		return resultValue(res)
 	}
 
-	CurrentStats.Incr(MMissExpired, 1)
-	// 缓存过期，但是在可接受的过期范围内，返回缓存内容，并触发更新任务
-	v, err := hc.opt.Encoder.Decode(value.Bytes)
+	if state == stateEarlyRefresh {
+		hc.outcome(span, MHit)
+		hc.stats.Incr(MEarlyRefresh, 1)
+	} else {
+		hc.outcome(span, MMissExpired)
+	}
+	// 缓存过期，但是在可接受的过期范围内（或者需要提前刷新），返回缓存内容，并触发更新任务
+	hc.staleness(value)
+	v, err = hc.decodeValue(ctx, cacheKey, value, state)
+	if hc.undecodable(err) {
+		return hc.loadValue(ctx, cacheKey, args)
+	}
 	if err == nil {
 		hc.Trigger(&EventCacheExpired{
-			Args: args,
+			Args:        args,
+			Key:         cacheKey,
+			SpanContext: spanContext(ctx),
 		})
 	}
 	return v, err
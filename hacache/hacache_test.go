@@ -2,15 +2,22 @@ package hacache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/vmihailenco/msgpack/v5"
+	"github.com/xiachufang/pkg/v2/metrics"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace/testtrace"
 )
 
 type Value struct {
@@ -23,7 +30,7 @@ type LocalStorage struct {
 	mu   sync.Mutex
 }
 
-func (s *LocalStorage) Get(key string) ([]byte, error) {
+func (s *LocalStorage) Get(ctx context.Context, key string) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if v, ok := s.Data[key]; ok {
@@ -33,7 +40,7 @@ func (s *LocalStorage) Get(key string) ([]byte, error) {
 	return nil, fmt.Errorf("key %s not found", key)
 }
 
-func (s *LocalStorage) Set(key string, value []byte, expiarion time.Duration) error {
+func (s *LocalStorage) Set(ctx context.Context, key string, value []byte, expiarion time.Duration) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.Data[key] = &Value{value: value, expireAt: time.Now().Unix() + int64(expiarion.Seconds())}
@@ -41,6 +48,55 @@ func (s *LocalStorage) Set(key string, value []byte, expiarion time.Duration) er
 	return nil
 }
 
+// CountLocalStorage 记录读取次数的 LocalStorage
+type CountLocalStorage struct {
+	LocalStorage
+	GetTimes int32
+}
+
+func (s *CountLocalStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	atomic.AddInt32(&s.GetTimes, 1)
+	return s.LocalStorage.Get(ctx, key)
+}
+
+// MultiLocalStorage 支持批量读取的 LocalStorage
+type MultiLocalStorage struct {
+	LocalStorage
+	MGetTimes int32
+}
+
+func (s *MultiLocalStorage) MGet(ctx context.Context, keys []string) ([][]byte, error) {
+	atomic.AddInt32(&s.MGetTimes, 1)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i], _ = s.Get(ctx, key)
+	}
+	return values, nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Data, key)
+
+	return nil
+}
+
+// SlowStorage 写入缓存比较慢的 LocalStorage
+type SlowStorage struct {
+	LocalStorage
+	SetDelay time.Duration
+}
+
+func (s *SlowStorage) Set(ctx context.Context, key string, value []byte, expiarion time.Duration) error {
+	select {
+	case <-time.After(s.SetDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.LocalStorage.Set(ctx, key, value, expiarion)
+}
+
 type MyEncoder struct{}
 
 func (enc *MyEncoder) Encode(v interface{}) ([]byte, error) {
@@ -86,7 +142,7 @@ func TestHaCache_Cache_basic(t *testing.T) {
 	if err != nil {
 		t.Fatal("init ha-cache error")
 	}
-	res, err := hc.Do("jack")
+	res, err := hc.Do(context.Background(), "jack")
 	// 这里等待 50ms，让刷新缓存的 goroutine 跑起来
 	time.Sleep(50 * time.Millisecond)
 
@@ -99,7 +155,7 @@ func TestHaCache_Cache_basic(t *testing.T) {
 		t.Fatal("cached value error: ", *jack)
 	}
 
-	res2, err := hc.Do("jack")
+	res2, err := hc.Do(context.Background(), "jack")
 	jack2, ok := res2.(*Foo)
 	if !ok || err != nil {
 		t.Fatal("decode error: ", err, res)
@@ -127,12 +183,12 @@ func TestHaCache_SkipCache(t *testing.T) {
 		t.Fatal("init ha-cache error")
 	}
 
-	v1, err := hc.Do("skip")
+	v1, err := hc.Do(context.Background(), "skip")
 	if err != nil {
 		t.Fatal("cache run error: ", err)
 	}
 
-	v2, err := hc.Do("skip")
+	v2, err := hc.Do(context.Background(), "skip")
 	if err != nil {
 		t.Fatal("cache run error: ", err)
 	}
@@ -141,7 +197,7 @@ func TestHaCache_SkipCache(t *testing.T) {
 		t.Fatal("skip cache error: ", v1, v2)
 	}
 
-	v3, err := hc.Do("skip")
+	v3, err := hc.Do(context.Background(), "skip")
 	if err != nil {
 		t.Fatal("cache run error: ", err)
 	}
@@ -181,14 +237,14 @@ func TestHaCache_Cache_expiration(t *testing.T) {
 		t.Fatal("init hc error: ", err)
 	}
 
-	if _, e := hc.Do("aa"); e != nil {
+	if _, e := hc.Do(context.Background(), "aa"); e != nil {
 		t.Error(e)
 	}
 
 	time.Sleep(2 * time.Second)
 
 	var v *ExpValue
-	if result, err := hc.Do("aa"); err == nil {
+	if result, err := hc.Do(context.Background(), "aa"); err == nil {
 		v = result.(*ExpValue)
 	}
 
@@ -204,7 +260,7 @@ func TestHaCache_Cache_expiration(t *testing.T) {
 	// 触发了缓存更新任务，这里拿到的会是最新的
 	// 完全过期，强制更新
 	time.Sleep(5 * time.Second)
-	res, _ := hc.Do("aa")
+	res, _ := hc.Do(context.Background(), "aa")
 	now := time.Now().Unix()
 	if now-res.(*ExpValue).CreateTS > 1 {
 		t.Fatal("background worker error: ", now, res.(*ExpValue).CreateTS)
@@ -215,7 +271,7 @@ func TestHaCache_Cache_expiration(t *testing.T) {
 	// 这里缓存过期时间太长，缓存无效，触发同步更新
 	time.Sleep(3 * time.Second)
 
-	res, _ = hc.Do("aa")
+	res, _ = hc.Do(context.Background(), "aa")
 	if time.Now().Unix()-res.(*ExpValue).CreateTS > 1 {
 		t.Fatal("background worker error")
 	}
@@ -261,7 +317,7 @@ func TestHaCache_Cache_limit(t *testing.T) {
 	wg.Add(5)
 	for i := 0; i < 5; i++ {
 		go func(age int) {
-			_, err := hc.Do(age)
+			_, err := hc.Do(context.Background(), age)
 			if err == nil {
 				atomic.AddInt32(&successCnt, 1)
 			}
@@ -326,10 +382,1764 @@ func TestHaCache_Context(t *testing.T) {
 		t.Fatal("init hacache error: ", err)
 	}
 
-	v1, _ = hc.Do()
+	v1, _ = hc.Do(context.Background())
 	time.Sleep(time.Second)
-	v2, _ = hc.Do()
+	v2, _ = hc.Do(context.Background())
 	if v1.(int64) != v2.(int64) {
 		t.Fatal("cache context test fail: ", v1, v2)
 	}
 }
+
+func TestHaCache_ContextCancel(t *testing.T) {
+	var fn = func(ctx context.Context, name string) *FnResult {
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+		return &FnResult{Val: name}
+	}
+
+	hc, err := New(&Options{
+		FnRunLimit: 1,
+		Storage:    &LocalStorage{Data: make(map[string]*Value)},
+		GenKeyFn:   func(name string) string { return name + "-cancel" },
+		Fn:         fn,
+		Encoder:    &TypedEncoder[string]{},
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := hc.Do(ctx, "tom"); err != context.DeadlineExceeded {
+		t.Fatal("expect deadline exceeded, got: ", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("do did not return after ctx deadline")
+	}
+	// 原函数收到 ctx 取消返回之后释放并发额度
+	for i := 0; i < 100 && hc.fnRunLimiter.GetCurrent() != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := hc.fnRunLimiter.GetCurrent(); n != 0 {
+		t.Fatal("fn run limiter slot not released: ", n)
+	}
+
+	// 已经取消的 ctx 不会执行原函数
+	if _, err := hc.Do(ctx, "jerry"); err != context.DeadlineExceeded {
+		t.Fatal("expect deadline exceeded, got: ", err)
+	}
+}
+
+// nolint: errcheck
+func TestHaCache_Coalesce(t *testing.T) {
+	var runs int32
+	var fn = func(name string) *FnResult {
+		atomic.AddInt32(&runs, 1)
+		time.Sleep(200 * time.Millisecond)
+		return &FnResult{Val: &Foo{Bar: name}}
+	}
+
+	hc, err := New(&Options{
+		FnRunLimit: 1,
+		Storage:    &LocalStorage{Data: make(map[string]*Value)},
+		GenKeyFn:   func(name string) string { return name + "-coalesce" },
+		Fn:         fn,
+		Encoder:    &MyEncoder{},
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	coalesced := atomic.LoadInt64(&CurrentStats.FnRunCoalesced)
+
+	// 10 个并发请求同时 miss，只执行一次原函数，不会触发限流
+	var successCnt int32
+	var wg sync.WaitGroup
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			defer wg.Done()
+			v, err := hc.Do(context.Background(), "tom")
+			if err == nil && v.(*Foo).Bar == "tom" {
+				atomic.AddInt32(&successCnt, 1)
+			}
+		}()
+	}
+
+	// 等待时间受自己的 ctx 控制，不影响其他请求
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := hc.Do(ctx, "tom"); err != context.DeadlineExceeded {
+		t.Fatal("expect deadline exceeded, got: ", err)
+	}
+	wg.Wait()
+
+	if successCnt != 10 {
+		t.Fatal("expect success: 10, got: ", successCnt)
+	}
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatal("expect fn run once, got: ", n)
+	}
+	if n := atomic.LoadInt64(&CurrentStats.FnRunCoalesced) - coalesced; n != 10 {
+		t.Fatal("expect 10 coalesced calls, got: ", n)
+	}
+}
+
+// nolint: errcheck
+func TestHaCache_Invalidate(t *testing.T) {
+	var runs int32
+	var fn = func(name string) *FnResult {
+		n := atomic.AddInt32(&runs, 1)
+		return &FnResult{Val: &Foo{Bar: name + strconv.Itoa(int(n))}}
+	}
+
+	hc, err := New(&Options{
+		Storage:  &LocalStorage{Data: make(map[string]*Value)},
+		GenKeyFn: func(name string) string { return name + "-invalidate" },
+		Fn:       fn,
+		Encoder:  &MyEncoder{},
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	ctx := context.Background()
+	hc.Do(ctx, "tom")
+	time.Sleep(50 * time.Millisecond)
+	if v, _ := hc.Do(ctx, "tom"); v.(*Foo).Bar != "tom1" || !v.(*Foo).Cached {
+		t.Fatal("expect cached tom1, got: ", v)
+	}
+
+	if err := hc.Invalidate(ctx, "tom"); err != nil {
+		t.Fatal("invalidate error: ", err)
+	}
+	if v, _ := hc.Do(ctx, "tom"); v.(*Foo).Bar != "tom2" || v.(*Foo).Cached {
+		t.Fatal("expect fresh tom2, got: ", v)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := hc.Delete(ctx, "tom-invalidate"); err != nil {
+		t.Fatal("delete error: ", err)
+	}
+	if v, _ := hc.Do(ctx, "tom"); v.(*Foo).Bar != "tom3" {
+		t.Fatal("expect fresh tom3, got: ", v)
+	}
+
+	// 删除不存在的 key 不报错
+	if err := hc.Delete(ctx, "not-exists"); err != nil {
+		t.Fatal("delete not exists key error: ", err)
+	}
+}
+
+// nolint: errcheck
+func TestHaCache_InvalidateTag(t *testing.T) {
+	var runs int32
+	store := &LocalStorage{Data: make(map[string]*Value)}
+	newCache := func(suffix string) *HaCache {
+		hc, err := New(&Options{
+			Storage:  store,
+			GenKeyFn: func(name string) string { return name + suffix },
+			Fn: func(name string) *FnResult {
+				atomic.AddInt32(&runs, 1)
+				return &FnResult{Val: &Foo{Bar: name}, Tags: []string{"user:" + name}}
+			},
+			Encoder: &MyEncoder{},
+		})
+		if err != nil {
+			t.Fatal("init hacache error: ", err)
+		}
+		return hc
+	}
+	profile, feed := newCache("-profile"), newCache("-feed")
+
+	ctx := context.Background()
+	profile.Do(ctx, "tom")
+	feed.Do(ctx, "tom")
+	feed.Do(ctx, "jerry")
+	time.Sleep(50 * time.Millisecond)
+
+	for _, hc := range []*HaCache{profile, feed} {
+		if v, _ := hc.Do(ctx, "tom"); !v.(*Foo).Cached {
+			t.Fatal("expect cached value, got: ", v)
+		}
+	}
+	if n := atomic.LoadInt32(&runs); n != 3 {
+		t.Fatal("expect fn run 3 times, got: ", n)
+	}
+
+	if err := profile.InvalidateTag(ctx, "user:tom"); err != nil {
+		t.Fatal("invalidate tag error: ", err)
+	}
+	for _, hc := range []*HaCache{profile, feed} {
+		if v, _ := hc.Do(ctx, "tom"); v.(*Foo).Cached {
+			t.Fatal("expect fresh value after tag invalidated, got: ", v)
+		}
+	}
+	if v, _ := feed.Do(ctx, "jerry"); !v.(*Foo).Cached {
+		t.Fatal("expect cached value of other tag, got: ", v)
+	}
+	if n := atomic.LoadInt32(&runs); n != 5 {
+		t.Fatal("expect fn run 5 times, got: ", n)
+	}
+
+	// 写入新的缓存后，tag 版本一致，重新命中缓存
+	time.Sleep(50 * time.Millisecond)
+	if v, _ := feed.Do(ctx, "tom"); !v.(*Foo).Cached {
+		t.Fatal("expect cached value after refresh, got: ", v)
+	}
+}
+
+// nolint: errcheck
+func TestHaCache_Close(t *testing.T) {
+	store := &SlowStorage{LocalStorage: LocalStorage{Data: make(map[string]*Value)}, SetDelay: 20 * time.Millisecond}
+	hc, err := New(&Options{
+		Storage:  store,
+		GenKeyFn: func(name string) string { return name + "-close" },
+		Fn:       fn2,
+		Encoder:  &MyEncoder{},
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	ctx := context.Background()
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		if _, err := hc.Do(ctx, name); err != nil {
+			t.Fatal("do error: ", err)
+		}
+	}
+
+	// Close 会等待所有缓存写入完成
+	closeCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := hc.Close(closeCtx); err != nil {
+		t.Fatal("close error: ", err)
+	}
+	for _, name := range names {
+		if _, err := store.Get(ctx, name+"-close"); err != nil {
+			t.Fatal("pending cache write lost: ", name)
+		}
+	}
+
+	if _, err := hc.Do(ctx, "a"); err != ErrorCacheClosed {
+		t.Fatal("expect cache closed error, got: ", err)
+	}
+	if err := hc.Close(ctx); err != nil {
+		t.Fatal("close twice error: ", err)
+	}
+
+	// 超时后放弃未完成的写入
+	hc, _ = New(&Options{
+		Storage:  &SlowStorage{LocalStorage: LocalStorage{Data: make(map[string]*Value)}, SetDelay: time.Second},
+		GenKeyFn: func(name string) string { return name + "-close-timeout" },
+		Fn:       fn2,
+		Encoder:  &MyEncoder{},
+	})
+	for _, name := range names {
+		hc.Do(ctx, name)
+	}
+	closeCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := hc.Close(closeCtx); err != context.DeadlineExceeded {
+		t.Fatal("expect deadline exceeded, got: ", err)
+	}
+}
+
+// KeySlowStorage 写入指定 key 比较慢的 LocalStorage
+type KeySlowStorage struct {
+	LocalStorage
+	SlowKey string
+}
+
+func (s *KeySlowStorage) Set(ctx context.Context, key string, value []byte, expiarion time.Duration) error {
+	if key == s.SlowKey {
+		time.Sleep(500 * time.Millisecond)
+	}
+	return s.LocalStorage.Set(ctx, key, value, expiarion)
+}
+
+// nolint: errcheck
+func TestHaCache_Workers(t *testing.T) {
+	store := &KeySlowStorage{LocalStorage: LocalStorage{Data: make(map[string]*Value)}, SlowKey: "slow-workers"}
+	hc, err := New(&Options{
+		Storage:  store,
+		GenKeyFn: func(name string) string { return name + "-workers" },
+		Fn:       fn2,
+		Encoder:  &MyEncoder{},
+		Workers:  4,
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	ctx := context.Background()
+	hc.Do(ctx, "slow")
+	time.Sleep(10 * time.Millisecond)
+
+	// 与 slow 不在同一个 worker 的 key，写入缓存不会被 slow 阻塞
+	slowShard := shard("slow-workers", 4)
+	var names []string
+	for i := 0; len(names) < 5; i++ {
+		name := strconv.Itoa(i)
+		if shard(name+"-workers", 4) != slowShard {
+			names = append(names, name)
+			hc.Do(ctx, name)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	for _, name := range names {
+		if _, err := store.Get(ctx, name+"-workers"); err != nil {
+			t.Fatal("cache write blocked by slow worker: ", name)
+		}
+	}
+	if _, err := store.Get(ctx, "slow-workers"); err == nil {
+		t.Fatal("expect slow cache write not finished")
+	}
+
+	if err := hc.Close(ctx); err != nil {
+		t.Fatal("close error: ", err)
+	}
+	if n := atomic.LoadInt32(&hc.queued); n != 0 {
+		t.Fatal("expect empty event queue, got: ", n)
+	}
+}
+
+// nolint: errcheck
+func TestHaCache_EarlyRefresh(t *testing.T) {
+	store := &LocalStorage{Data: make(map[string]*Value)}
+	hc, err := New(&Options{
+		Storage:  store,
+		GenKeyFn: func(name string) string { return name + "-early" },
+		Fn: func(name string) *FnResult {
+			time.Sleep(30 * time.Millisecond)
+			return &FnResult{Val: &Foo{Bar: name}}
+		},
+		Encoder:          &MyEncoder{},
+		Expiration:       time.Hour,
+		EarlyRefreshBeta: 1,
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	ctx := context.Background()
+	hc.Do(ctx, "tom")
+	time.Sleep(50 * time.Millisecond)
+
+	// 记录原函数执行耗时
+	value, err := hc.Get(ctx, "tom-early")
+	if err != nil || value.Delta < 30 {
+		t.Fatal("expect fn cost recorded, got: ", value, err)
+	}
+
+	// 距离过期时间很远，不会提前刷新
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if hc.state(value, now) != stateFresh {
+			t.Fatal("unexpected early refresh")
+		}
+	}
+
+	// 原函数耗时相对于剩余有效期很长，大概率提前刷新
+	value.CreateTS = now.Unix() - int64(time.Hour.Seconds()) + 1
+	value.Delta = time.Hour.Milliseconds()
+	early := 0
+	for i := 0; i < 100; i++ {
+		if hc.state(value, now) == stateEarlyRefresh {
+			early++
+		}
+	}
+	if early < 90 {
+		t.Fatal("expect early refresh near expiration, got: ", early)
+	}
+
+	// 没有开启时不会提前刷新
+	hc.opt.EarlyRefreshBeta = 0
+	if hc.state(value, now) != stateFresh {
+		t.Fatal("unexpected early refresh when disabled")
+	}
+}
+
+// nolint: errcheck
+func TestHaCache_ExpirationJitter(t *testing.T) {
+	store := &LocalStorage{Data: make(map[string]*Value)}
+	hc, err := New(&Options{
+		Storage:                 store,
+		GenKeyFn:                func(name string) string { return name + "-jitter" },
+		Fn:                      fn2,
+		Encoder:                 &MyEncoder{},
+		Expiration:              time.Hour,
+		MaxAcceptableExpiration: time.Minute,
+		ExpirationJitter:        0.5,
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	ctx := context.Background()
+	expirations := make(map[int64]bool)
+	for i := 0; i < 20; i++ {
+		key := strconv.Itoa(i)
+		if err := hc.Set(ctx, key, &Foo{Bar: key}); err != nil {
+			t.Fatal("set error: ", err)
+		}
+
+		value, _ := hc.Get(ctx, key)
+		expiration := time.Duration(value.Expiration) * time.Millisecond
+		if expiration < 30*time.Minute || expiration > 90*time.Minute {
+			t.Fatal("expiration out of jitter range: ", expiration)
+		}
+		expirations[value.Expiration] = true
+
+		// storage 中的过期时间也随之浮动
+		// CreateTS 与 storage 写入时间可能跨秒
+		ttl := store.Data[key].expireAt - value.CreateTS
+		if diff := ttl - int64((expiration + time.Minute).Seconds()); diff < 0 || diff > 1 {
+			t.Fatal("storage ttl not jittered: ", ttl, expiration)
+		}
+
+		// 有效期判断使用浮动后的过期时间
+		created := time.Unix(value.CreateTS, 0)
+		if hc.state(value, created.Add(expiration-time.Second)) != stateFresh {
+			t.Fatal("expect fresh before jittered expiration")
+		}
+		if hc.state(value, created.Add(expiration+2*time.Second)) != stateExpired {
+			t.Fatal("expect expired after jittered expiration")
+		}
+	}
+	if len(expirations) < 10 {
+		t.Fatal("expect random expirations, got: ", expirations)
+	}
+}
+
+// nolint: errcheck
+func TestHaCache_ResultExpiration(t *testing.T) {
+	store := &LocalStorage{Data: make(map[string]*Value)}
+	hc, err := New(&Options{
+		Storage:  store,
+		GenKeyFn: func(name string) string { return name + "-result-expiration" },
+		Fn: func(name string) *FnResult {
+			if name == "trending" {
+				return &FnResult{Val: &Foo{Bar: name}, Expiration: time.Minute, MaxStale: 10 * time.Second}
+			}
+			return &FnResult{Val: &Foo{Bar: name}}
+		},
+		Encoder:                 &MyEncoder{},
+		Expiration:              time.Hour,
+		MaxAcceptableExpiration: time.Hour,
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	ctx := context.Background()
+	for _, name := range []string{"trending", "archived"} {
+		if _, err := hc.Do(ctx, name); err != nil {
+			t.Fatal("do error: ", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	cases := []struct {
+		key                  string
+		expiration, maxStale time.Duration
+	}{
+		{"trending-result-expiration", time.Minute, 10 * time.Second},
+		{"archived-result-expiration", time.Hour, time.Hour},
+	}
+	for _, c := range cases {
+		value, err := hc.Get(ctx, c.key)
+		if err != nil {
+			t.Fatal("get error: ", err)
+		}
+
+		// storage 中的过期时间使用原函数返回的有效期
+		ttl := store.Data[c.key].expireAt - value.CreateTS
+		if diff := ttl - int64((c.expiration + c.maxStale).Seconds()); diff < 0 || diff > 1 {
+			t.Fatal("unexpected storage ttl: ", c.key, ttl)
+		}
+
+		created := time.Unix(value.CreateTS, 0)
+		if hc.state(value, created.Add(c.expiration-time.Second)) != stateFresh {
+			t.Fatal("expect fresh before expiration: ", c.key)
+		}
+		if hc.state(value, created.Add(c.expiration+2*time.Second)) != stateExpired {
+			t.Fatal("expect expired after expiration: ", c.key)
+		}
+		if hc.state(value, created.Add(c.expiration+c.maxStale+2*time.Second)) != stateInvalid {
+			t.Fatal("expect invalid after max stale: ", c.key)
+		}
+	}
+}
+
+func TestHaCache_L1(t *testing.T) {
+	store := &CountLocalStorage{LocalStorage: LocalStorage{Data: make(map[string]*Value)}}
+	hc, err := New(&Options{
+		Storage:                 store,
+		GenKeyFn:                func(name string) string { return name + "-l1" },
+		Fn:                      func(name string) *FnResult { return &FnResult{Val: &Foo{Bar: name}} },
+		Encoder:                 &MyEncoder{},
+		Expiration:              time.Second,
+		MaxAcceptableExpiration: time.Minute,
+		L1Size:                  1,
+		L1TTL:                   time.Hour,
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	ctx := context.Background()
+	hc.Do(ctx, "tom")
+	time.Sleep(50 * time.Millisecond)
+
+	// 写入缓存时同时写入 L1，之后不再读取 storage
+	for i := 0; i < 3; i++ {
+		v, err := hc.Do(ctx, "tom")
+		if err != nil || v.(*Foo).Bar != "tom" {
+			t.Fatal("unexpected value: ", v, err)
+		}
+		// 修改返回值不影响 L1 中的值
+		v.(*Foo).Bar = "modified"
+	}
+	if n := atomic.LoadInt32(&store.GetTimes); n != 1 {
+		t.Fatal("expect 1 storage get, got: ", n)
+	}
+	if n := atomic.LoadInt64(&hc.Stats().L1Hit); n != 3 {
+		t.Fatal("expect 3 l1 hits, got: ", n)
+	}
+
+	// 超过容量时淘汰
+	hc.Do(ctx, "jerry")
+	time.Sleep(50 * time.Millisecond)
+	hc.Do(ctx, "tom")
+	if n := atomic.LoadInt32(&store.GetTimes); n != 3 {
+		t.Fatal("expect 3 storage gets after eviction, got: ", n)
+	}
+
+	// L1 只返回有效期内的缓存值，缓存时间精度为秒
+	time.Sleep(2100 * time.Millisecond)
+	gets := atomic.LoadInt32(&store.GetTimes)
+	if v, _ := hc.Do(ctx, "tom"); v.(*Foo).Bar != "tom" || !v.(*Foo).Cached {
+		t.Fatal("expect expired value from storage, got: ", v)
+	}
+	if n := atomic.LoadInt32(&store.GetTimes) - gets; n != 1 {
+		t.Fatal("expect storage get after expiration, got: ", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// 删除缓存同时删除 L1
+	if err := hc.Delete(ctx, "tom-l1"); err != nil {
+		t.Fatal("delete error: ", err)
+	}
+	if _, ok := hc.l1.get("tom-l1", time.Now()); ok {
+		t.Fatal("expect l1 deleted")
+	}
+}
+
+func TestHaCache_NegativeCache(t *testing.T) {
+	var runs int32
+	errTemporary := errors.New("temporary error")
+	errPermanent := errors.New("permanent error")
+	var fn = func(name string) *FnResult {
+		atomic.AddInt32(&runs, 1)
+		switch name {
+		case "temporary":
+			return &FnResult{Err: errTemporary}
+		case "permanent":
+			return &FnResult{Err: errPermanent}
+		}
+		return &FnResult{NotFound: true}
+	}
+
+	newCache := func(negativeExpiration time.Duration) *HaCache {
+		hc, err := New(&Options{
+			Storage:            &LocalStorage{Data: make(map[string]*Value)},
+			GenKeyFn:           func(name string) string { return name + "-negative" },
+			Fn:                 fn,
+			Encoder:            &MyEncoder{},
+			NegativeExpiration: negativeExpiration,
+			CacheableErr:       func(err error) bool { return err == errPermanent },
+		})
+		if err != nil {
+			t.Fatal("init hacache error: ", err)
+		}
+		return hc
+	}
+
+	ctx := context.Background()
+	// 缓存时间精度为秒
+	hc := newCache(time.Second)
+	expectRuns := func(name string, err error, n int32) {
+		atomic.StoreInt32(&runs, 0)
+		for i := 0; i < 3; i++ {
+			if _, e := hc.Do(ctx, name); e == nil || e.Error() != err.Error() {
+				t.Fatalf("%s: expect error %v, got: %v", name, err, e)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if r := atomic.LoadInt32(&runs); r != n {
+			t.Fatalf("%s: expect fn run %d times, got: %d", name, n, r)
+		}
+	}
+
+	// 不存在的结果写入负缓存
+	expectRuns("tom", ErrorNotFound, 1)
+	// CacheableErr 允许缓存的 error 写入负缓存，返回 *CachedError
+	expectRuns("permanent", errPermanent, 1)
+	if _, err := hc.Do(ctx, "permanent"); err == nil {
+		t.Fatal("expect cached error")
+	} else if _, ok := err.(*CachedError); !ok {
+		t.Fatalf("expect *CachedError, got: %T", err)
+	}
+	// 其他 error 不写入缓存
+	expectRuns("temporary", errTemporary, 3)
+
+	// 负缓存过期后按缓存 miss 处理
+	time.Sleep(2 * time.Second)
+	expectRuns("tom", ErrorNotFound, 1)
+
+	// 没有开启负缓存，每次都执行原函数
+	hc = newCache(0)
+	expectRuns("tom", ErrorNotFound, 3)
+	expectRuns("permanent", errPermanent, 3)
+}
+
+// LocalLease 进程内的 RefreshLease，不处理租约的有效期
+type LocalLease struct {
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func (l *LocalLease) Acquire(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.tokens[key]; ok {
+		return false, nil
+	}
+	l.tokens[key] = token
+	return true, nil
+}
+
+func (l *LocalLease) Release(ctx context.Context, key, token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tokens[key] == token {
+		delete(l.tokens, key)
+	}
+	return nil
+}
+
+func TestHaCache_RefreshLease(t *testing.T) {
+	store := &LocalStorage{Data: make(map[string]*Value)}
+	lease := &LocalLease{tokens: make(map[string]string)}
+	var runs, fail int32
+	// 后台更新等待 gate 关闭后返回，保证所有实例都读取到过期缓存
+	gate := make(chan struct{})
+	newCache := func() *HaCache {
+		hc, err := New(&Options{
+			Name:         "refresh-lease",
+			Storage:      store,
+			RefreshLease: lease,
+			GenKeyFn:     func(name string) string { return name + "-lease" },
+			Fn: func(name string) *FnResult {
+				atomic.AddInt32(&runs, 1)
+				if atomic.LoadInt32(&fail) == 1 {
+					return &FnResult{Err: errors.New("db down")}
+				}
+				<-gate
+				return &FnResult{Val: &Foo{Bar: name}}
+			},
+			Encoder:                 &MyEncoder{},
+			Expiration:              time.Hour,
+			MaxAcceptableExpiration: time.Hour,
+		})
+		if err != nil {
+			t.Fatal("init hacache error: ", err)
+		}
+		return hc
+	}
+
+	// 写入已经过期，但是在可接受过期范围内的缓存
+	ctx := context.Background()
+	b, _ := (&MyEncoder{}).Encode(&Foo{Bar: "stale"})
+	value, _ := msgpack.Marshal(CachedValue{Bytes: b, CreateTS: time.Now().Add(-2 * time.Hour).Unix()})
+	_ = store.Set(ctx, "hot-lease", value, time.Hour)
+
+	// 更新失败时释放租约
+	atomic.StoreInt32(&fail, 1)
+	hc := newCache()
+	if v, err := hc.Do(ctx, "hot"); err != nil || v.(*Foo).Bar != "stale" {
+		t.Fatal("expect stale value: ", v, err)
+	}
+	_ = hc.Close(ctx)
+	if runs != 1 || len(lease.tokens) != 0 {
+		t.Fatal("expect lease released after failed refresh, runs: ", runs, ", leases: ", lease.tokens)
+	}
+
+	// 多个实例同时命中过期缓存，只有一个实例执行后台更新
+	atomic.StoreInt32(&fail, 0)
+	atomic.StoreInt32(&runs, 0)
+	instances := make([]*HaCache, 5)
+	for i := range instances {
+		instances[i] = newCache()
+	}
+	for _, hc := range instances {
+		if v, err := hc.Do(ctx, "hot"); err != nil || v.(*Foo).Bar != "stale" {
+			t.Fatal("expect stale value: ", v, err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+
+	var skipped int64
+	for _, hc := range instances {
+		_ = hc.Close(ctx)
+		skipped += hc.Stats().Snapshot()[MRefreshLeaseSkipped]
+	}
+	if runs != 1 || skipped != 4 {
+		t.Fatal("expect only one instance refreshing, runs: ", runs, ", skipped: ", skipped)
+	}
+	// 更新成功后释放租约，不阻塞下一次过期时的更新
+	if len(lease.tokens) != 0 {
+		t.Fatal("expect lease released after refresh: ", lease.tokens)
+	}
+	cached, err := hc.Get(ctx, "hot-lease")
+	if err != nil || cached.CreateTS < time.Now().Add(-time.Minute).Unix() {
+		t.Fatal("expect refreshed value: ", cached, err)
+	}
+}
+
+// LocalBus 进程内的 InvalidationBus，Publish 同步调用订阅者
+type LocalBus struct {
+	mu          sync.Mutex
+	subscribers map[int]func(string)
+	resets      map[int]func()
+	next        int
+}
+
+func (b *LocalBus) Publish(ctx context.Context, channel, message string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, fn := range b.subscribers {
+		fn(message)
+	}
+	return nil
+}
+
+func (b *LocalBus) Subscribe(channel string, onMessage func(message string), onSubscribe func()) (func() error, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = onMessage
+	b.resets[id] = onSubscribe
+	onSubscribe()
+	return func() error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+		delete(b.resets, id)
+		return nil
+	}, nil
+}
+
+// Resubscribe 模拟断开后重新订阅
+func (b *LocalBus) Resubscribe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, fn := range b.resets {
+		fn()
+	}
+}
+
+func TestHaCache_InvalidationBus(t *testing.T) {
+	store := &LocalStorage{Data: make(map[string]*Value)}
+	bus := &LocalBus{subscribers: make(map[int]func(string)), resets: make(map[int]func())}
+	var version int32 = 1
+	newCache := func() *HaCache {
+		hc, err := New(&Options{
+			Name:            "invalidation-bus",
+			Storage:         store,
+			InvalidationBus: bus,
+			GenKeyFn:        func(name string) string { return name + "-bus" },
+			Fn: func(name string) *FnResult {
+				return &FnResult{Val: &Foo{Bar: fmt.Sprint(name, atomic.LoadInt32(&version))}}
+			},
+			Encoder:    &MyEncoder{},
+			Expiration: time.Hour,
+			L1Size:     10,
+			L1TTL:      time.Hour,
+		})
+		if err != nil {
+			t.Fatal("init hacache error: ", err)
+		}
+		return hc
+	}
+
+	ctx := context.Background()
+	a, b := newCache(), newCache()
+	if _, err := a.Do(ctx, "x"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if v, err := b.Do(ctx, "x"); err != nil || v.(*Foo).Bar != "x1" {
+		t.Fatal("expect x1: ", v, err)
+	}
+	if _, ok := b.l1.get("x-bus", time.Now()); !ok {
+		t.Fatal("expect value in l1")
+	}
+
+	// a 删除缓存后，b 删除 L1 中的旧值，重新读取
+	atomic.StoreInt32(&version, 2)
+	if err := a.Invalidate(ctx, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Do(ctx, "x"); err != nil || v.(*Foo).Bar != "x2" {
+		t.Fatal("expect x2 after invalidation: ", v, err)
+	}
+
+	// 重新订阅时清空 L1
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := b.l1.get("x-bus", time.Now()); !ok {
+		t.Fatal("expect value in l1")
+	}
+	bus.Resubscribe()
+	if _, ok := b.l1.get("x-bus", time.Now()); ok {
+		t.Fatal("expect l1 purged after resubscribe")
+	}
+
+	_ = a.Close(ctx)
+	_ = b.Close(ctx)
+	if len(bus.subscribers) != 0 {
+		t.Fatal("expect unsubscribed after close: ", len(bus.subscribers))
+	}
+}
+
+func TestHaCache_Compression(t *testing.T) {
+	store := &LocalStorage{Data: make(map[string]*Value)}
+	newCache := func(compression Compression) *HaCache {
+		hc, err := New(&Options{
+			Storage:     store,
+			GenKeyFn:    func(name string) string { return name + "-compression" },
+			Fn:          func(name string) *FnResult { return &FnResult{Val: &Foo{Bar: name}} },
+			Encoder:     &MyEncoder{},
+			Expiration:  time.Hour,
+			Compression: compression,
+		})
+		if err != nil {
+			t.Fatal("init hacache error: ", err)
+		}
+		return hc
+	}
+
+	ctx := context.Background()
+	large := strings.Repeat("recipe ", 1000)
+	plain := newCache(CompressionNone)
+	for _, codec := range []Compression{CompressionSnappy, CompressionZstd, CompressionGzip} {
+		hc := newCache(codec)
+		key := hc.GenCacheKey(ctx, string(codec))
+		if err := hc.Set(ctx, key, &Foo{Bar: large}); err != nil {
+			t.Fatal(codec, " set error: ", err)
+		}
+		if err := hc.Set(ctx, "small-compression", &Foo{Bar: "small"}); err != nil {
+			t.Fatal(codec, " set error: ", err)
+		}
+
+		value, err := hc.Get(ctx, key)
+		if err != nil || value.Compression != codec || len(value.Bytes) >= len(large) {
+			t.Fatal(codec, " expect compressed value: ", value.Compression, len(value.Bytes), err)
+		}
+		// 小于阈值的不压缩
+		if value, _ := hc.Get(ctx, "small-compression"); value.Compression != CompressionNone {
+			t.Fatal(codec, " small value should not be compressed: ", value.Compression)
+		}
+
+		// 按缓存值记录的压缩算法解压，不开启压缩的实例也可以读取
+		for _, reader := range []*HaCache{hc, plain} {
+			v, err := reader.Do(ctx, string(codec))
+			if err != nil || v.(*Foo).Bar != large || !v.(*Foo).Cached {
+				t.Fatal(codec, " expect cached value: ", err)
+			}
+		}
+	}
+
+	// 未压缩的旧缓存值在开启压缩后仍然可以读取
+	if err := plain.Set(ctx, "old-compression", &Foo{Bar: large}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := newCache(CompressionZstd).Do(ctx, "old"); err != nil || v.(*Foo).Bar != large || !v.(*Foo).Cached {
+		t.Fatal("expect cached value: ", err)
+	}
+
+	if _, err := decompress("lz4", []byte("x")); !errors.Is(err, ErrorUnknownCompression) {
+		t.Fatal("expect unknown compression error, got ", err)
+	}
+
+	// 未知压缩算法写入的缓存值按缓存 miss 处理，执行原函数覆盖
+	b, _ := msgpack.Marshal(CachedValue{Bytes: []byte("x"), CreateTS: time.Now().Unix(), Compression: "lz4"})
+	_ = store.Set(ctx, "unknown-compression", b, time.Hour)
+	if v, err := plain.Do(ctx, "unknown"); err != nil || v.(*Foo).Bar != "unknown" || v.(*Foo).Cached {
+		t.Fatal("expect fn value for unknown compression: ", v, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if value, err := plain.Get(ctx, "unknown-compression"); err != nil || value.Compression != CompressionNone {
+		t.Fatal("expect value overwritten: ", value, err)
+	}
+}
+
+func TestHaCache_Encryption(t *testing.T) {
+	store := &LocalStorage{Data: make(map[string]*Value)}
+	k1, k2 := []byte(strings.Repeat("1", 32)), []byte(strings.Repeat("2", 16))
+	newCache := func(keyring *Keyring, compression Compression) *HaCache {
+		hc, err := New(&Options{
+			Storage:     store,
+			GenKeyFn:    func(name string) string { return name + "-encryption" },
+			Fn:          func(name string) *FnResult { return &FnResult{Val: &Foo{Bar: name}} },
+			Encoder:     &MyEncoder{},
+			Expiration:  time.Hour,
+			Keyring:     keyring,
+			Compression: compression,
+		})
+		if err != nil {
+			t.Fatal("init hacache error: ", err)
+		}
+		return hc
+	}
+
+	ctx := context.Background()
+	phone := "13800000000"
+	old := newCache(&Keyring{Current: "k1", Keys: map[string][]byte{"k1": k1}}, CompressionNone)
+	if err := old.Set(ctx, "a-encryption", &Foo{Bar: phone}); err != nil {
+		t.Fatal(err)
+	}
+	value, err := old.Get(ctx, "a-encryption")
+	if err != nil || value.KeyID != "k1" || strings.Contains(string(value.Bytes), phone) {
+		t.Fatal("expect encrypted value: ", value.KeyID, err)
+	}
+
+	// 轮换密钥：使用新密钥加密，旧密钥加密的缓存值仍然可以读取
+	rotated := newCache(&Keyring{Current: "k2", Keys: map[string][]byte{"k1": k1, "k2": k2}}, CompressionNone)
+	if v, err := rotated.Do(ctx, "a"); err != nil || v.(*Foo).Bar != phone || !v.(*Foo).Cached {
+		t.Fatal("expect value encrypted with old key: ", v, err)
+	}
+	if err := rotated.Set(ctx, "b-encryption", &Foo{Bar: phone}); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := rotated.Get(ctx, "b-encryption"); value.KeyID != "k2" {
+		t.Fatal("expect encrypted with current key, got ", value.KeyID)
+	}
+	// 滚动轮换时还没有新密钥的实例按缓存 miss 处理，执行原函数并使用自己的当前密钥覆盖
+	undecodable := old.Stats().Snapshot()[MUndecodable]
+	if v, err := old.Do(ctx, "b"); err != nil || v.(*Foo).Bar != "b" || v.(*Foo).Cached {
+		t.Fatal("expect fn value for unknown key id: ", v, err)
+	}
+	if n := old.Stats().Snapshot()[MUndecodable] - undecodable; n != 1 {
+		t.Fatal("expect 1 undecodable value, got ", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if value, _ := old.Get(ctx, "b-encryption"); value.KeyID != "k1" {
+		t.Fatal("expect value overwritten with k1, got ", value.KeyID)
+	}
+	if v, err := newCache(nil, CompressionNone).Do(ctx, "b"); err != nil || v.(*Foo).Bar != "b" || v.(*Foo).Cached {
+		t.Fatal("expect fn value without keyring: ", v, err)
+	}
+
+	// 密文绑定缓存 key，挪到其他 key 下无法解密，按缓存 miss 处理
+	b, _ := store.Get(ctx, "a-encryption")
+	_ = store.Set(ctx, "c-encryption", b, time.Hour)
+	if v, err := rotated.Do(ctx, "c"); err != nil || v.(*Foo).Bar != "c" || v.(*Foo).Cached {
+		t.Fatal("expect fn value for decrypt error: ", v, err)
+	}
+	moved, _ := rotated.Get(ctx, "a-encryption")
+	if _, err := rotated.decode(ctx, "c-encryption", moved); err != ErrorDecrypt {
+		t.Fatal("expect decrypt error, got ", err)
+	}
+
+	// 没有加密的旧缓存值仍然可以读取
+	if err := newCache(nil, CompressionNone).Set(ctx, "d-encryption", &Foo{Bar: phone}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := rotated.Do(ctx, "d"); err != nil || v.(*Foo).Bar != phone {
+		t.Fatal("expect plain value: ", v, err)
+	}
+
+	// 先压缩再加密
+	large := strings.Repeat(phone, 200)
+	compressed := newCache(&Keyring{Current: "k1", Keys: map[string][]byte{"k1": k1}}, CompressionZstd)
+	if err := compressed.Set(ctx, "e-encryption", &Foo{Bar: large}); err != nil {
+		t.Fatal(err)
+	}
+	value, _ = compressed.Get(ctx, "e-encryption")
+	if value.KeyID != "k1" || value.Compression != CompressionZstd || len(value.Bytes) >= len(large) {
+		t.Fatal("expect compressed and encrypted value: ", value.KeyID, value.Compression, len(value.Bytes))
+	}
+	if v, err := rotated.Do(ctx, "e"); err != nil || v.(*Foo).Bar != large {
+		t.Fatal("expect compressed value: ", err)
+	}
+
+	for _, keyring := range []*Keyring{
+		{Current: "k3", Keys: map[string][]byte{"k1": k1}},
+		{Current: "k1", Keys: map[string][]byte{"k1": []byte("short")}},
+		{Current: "", Keys: map[string][]byte{"": k1}},
+		{Current: "k1", Keys: map[string][]byte{"k1": k1, "": k2}},
+	} {
+		if _, err := New(&Options{Storage: store, Fn: fn2, GenKeyFn: func(name string) string { return name }, Keyring: keyring}); err == nil {
+			t.Fatal("expect invalid keyring error")
+		}
+	}
+}
+
+func TestHaCache_Stats(t *testing.T) {
+	newCache := func(name string) *HaCache {
+		hc, err := New(&Options{
+			Name:     name,
+			Storage:  &LocalStorage{Data: make(map[string]*Value)},
+			GenKeyFn: func(name string) string { return name + "-stats" },
+			Fn:       func(name string) *FnResult { return &FnResult{Val: &Foo{Bar: name}} },
+			Encoder:  &MyEncoder{},
+		})
+		if err != nil {
+			t.Fatal("init hacache error: ", err)
+		}
+		return hc
+	}
+
+	recipe, user := newCache("recipe"), newCache("")
+	if recipe.Stats().Name != "recipe" || user.Stats().Name != defaultStatsName {
+		t.Fatal("unexpected stats name: ", recipe.Stats().Name, user.Stats().Name)
+	}
+
+	ctx := context.Background()
+	fnRun := atomic.LoadInt64(&CurrentStats.FnRun)
+	recipe.Do(ctx, "tom")
+	recipe.Do(ctx, "jerry")
+	user.Do(ctx, "tom")
+
+	// 每个实例单独统计，同时汇总到 CurrentStats
+	if n := atomic.LoadInt64(&recipe.Stats().FnRun); n != 2 {
+		t.Fatal("expect recipe fn run 2, got: ", n)
+	}
+	if n := atomic.LoadInt64(&user.Stats().FnRun); n != 1 {
+		t.Fatal("expect user fn run 1, got: ", n)
+	}
+	// 其他测试的后台更新也会汇总到 CurrentStats
+	if n := atomic.LoadInt64(&CurrentStats.FnRun) - fnRun; n < 3 {
+		t.Fatal("expect aggregate fn run 3, got: ", n)
+	}
+
+	registered := func(stats *Stats) bool {
+		for _, instance := range CurrentStats.instances() {
+			if instance == stats {
+				return true
+			}
+		}
+		return false
+	}
+	if !registered(recipe.Stats()) || !registered(user.Stats()) {
+		t.Fatal("expect stats registered")
+	}
+
+	// 关闭后不再上报
+	recipe.Close(ctx)
+	user.Close(ctx)
+	if registered(recipe.Stats()) || registered(user.Stats()) {
+		t.Fatal("expect stats unregistered after close")
+	}
+}
+
+func TestStats_Prometheus(t *testing.T) {
+	hc, err := New(&Options{
+		Name:     "prometheus",
+		Storage:  &LocalStorage{Data: make(map[string]*Value)},
+		GenKeyFn: func(name string) string { return name + "-prometheus" },
+		Fn:       func(name string) *FnResult { return &FnResult{Val: &Foo{Bar: name}} },
+		Encoder:  &MyEncoder{},
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+	defer hc.Close(context.Background())
+
+	ctx := context.Background()
+	hc.Do(ctx, "tom")
+	time.Sleep(50 * time.Millisecond)
+	hc.Do(ctx, "tom")
+
+	// Export 返回增量，不影响累计值
+	if data := hc.Stats().Export(); data[MFnRun] != 1 || data[MHit] != 1 {
+		t.Fatal("unexpected export: ", data)
+	}
+	if data := hc.Stats().Export(); data[MFnRun] != 0 || data[MHit] != 0 {
+		t.Fatal("expect zero delta, got: ", data)
+	}
+	if data := hc.Stats().Snapshot(); data[MFnRun] != 1 || data[MHit] != 1 {
+		t.Fatal("unexpected snapshot: ", data)
+	}
+
+	for _, stats := range []*Stats{hc.Stats(), CurrentStats} {
+		w := httptest.NewRecorder()
+		stats.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		body := w.Body.String()
+		for _, line := range []string{
+			"# TYPE hacache_fn_run_total counter",
+			`hacache_fn_run_total{name="prometheus"} 1`,
+			`hacache_hit_total{name="prometheus"} 1`,
+			"# TYPE hacache_fn_run_concurrency gauge",
+			`hacache_fn_run_concurrency{name="prometheus"} 0`,
+		} {
+			if !strings.Contains(body, line+"\n") {
+				t.Fatalf("expect line %q in:\n%s", line, body)
+			}
+		}
+	}
+}
+
+func TestStats_Timing(t *testing.T) {
+	hc, err := New(&Options{
+		Name:     "timing",
+		Storage:  &LocalStorage{Data: make(map[string]*Value)},
+		GenKeyFn: func(name string) string { return name + "-timing" },
+		Fn: func(name string) *FnResult {
+			time.Sleep(10 * time.Millisecond)
+			return &FnResult{Val: &Foo{Bar: name}}
+		},
+		Encoder: &MyEncoder{},
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+	defer hc.Close(context.Background())
+
+	ctx := context.Background()
+	hc.Do(ctx, "tom")
+	time.Sleep(50 * time.Millisecond)
+	hc.Do(ctx, "tom")
+
+	timings := hc.Stats().ExportTimings()
+	for m, count := range map[TimingMetricType]uint64{
+		TMFnRun:      1,
+		TMStorageGet: 2,
+		TMStorageSet: 1,
+		TMEncode:     1,
+		TMDecode:     1,
+		TMStaleness:  1,
+	} {
+		if timings[m].Count != count {
+			t.Fatalf("expect %s count %d, got: %d", m, count, timings[m].Count)
+		}
+	}
+	if fnRun := timings[TMFnRun]; fnRun.Sum < 0.01 || fnRun.Counts[0] != 0 || fnRun.Counts[len(fnRun.Counts)-1] != 1 {
+		t.Fatal("unexpected fn run histogram: ", fnRun)
+	}
+	if CurrentStats.ExportTimings()[TMFnRun].Count < 1 {
+		t.Fatal("expect timings in aggregate stats")
+	}
+
+	w := httptest.NewRecorder()
+	hc.Stats().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		"# TYPE hacache_fn_run_duration_seconds histogram",
+		`hacache_fn_run_duration_seconds_bucket{name="timing",le="0.0005"} 0`,
+		`hacache_fn_run_duration_seconds_bucket{name="timing",le="+Inf"} 1`,
+		`hacache_fn_run_duration_seconds_count{name="timing"} 1`,
+		`hacache_staleness_seconds_count{name="timing"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Fatalf("expect line %q in:\n%s", line, w.Body.String())
+		}
+	}
+}
+
+func TestStats_MetricsSink(t *testing.T) {
+	sink := metrics.NewMemorySink()
+	hc, err := New(&Options{
+		Name:        "sink",
+		Storage:     &LocalStorage{Data: make(map[string]*Value)},
+		GenKeyFn:    func(name string) string { return name + "-sink" },
+		Fn:          func(name string) *FnResult { return &FnResult{Val: &Foo{Bar: name}} },
+		Encoder:     &MyEncoder{},
+		MetricsSink: sink,
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	ctx := context.Background()
+	hc.Do(ctx, "tom")
+	time.Sleep(50 * time.Millisecond)
+	hc.Do(ctx, "tom")
+
+	name := metrics.T("name", "sink")
+	// timing 立即上报
+	if n := len(sink.Timings("ha-cache-timing", metrics.T("m", string(TMFnRun)), name)); n != 1 {
+		t.Fatal("expect 1 fn run timing, got: ", n)
+	}
+	// 原函数执行并发限制
+	if v := sink.GaugeValue("limiter-concurrency", name); v != 0 {
+		t.Fatal("expect limiter concurrency 0, got: ", v)
+	}
+
+	// 计数器定时上报，关闭时上报最后一次
+	hc.Close(ctx)
+	if v := sink.Counter("ha-cache", metrics.T("m", string(MFnRun)), name); v != 1 {
+		t.Fatal("expect fn run 1, got: ", v)
+	}
+	if v := sink.Counter("ha-cache", metrics.T("m", string(MHit)), name); v != 1 {
+		t.Fatal("expect hit 1, got: ", v)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{1, 2})
+	for _, d := range []time.Duration{500 * time.Millisecond, time.Second, 1500 * time.Millisecond, 3 * time.Second} {
+		h.Observe(d)
+	}
+	snapshot := h.Snapshot()
+	// 上界包含等于的值
+	if snapshot.Counts[0] != 2 || snapshot.Counts[1] != 3 || snapshot.Count != 4 || snapshot.Sum != 6 {
+		t.Fatal("unexpected snapshot: ", snapshot)
+	}
+}
+
+func TestHaCache_Tracing(t *testing.T) {
+	tracer := testtrace.NewTracer()
+	hc, err := New(&Options{
+		Name:     "tracing",
+		Storage:  &LocalStorage{Data: make(map[string]*Value)},
+		GenKeyFn: func(name string) string { return name + "-tracing" },
+		Fn:       func(name string) *FnResult { return &FnResult{Val: &Foo{Bar: name}} },
+		Encoder:  &MyEncoder{},
+		Tracer:   tracer,
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+	defer hc.Close(context.Background())
+
+	ctx := context.Background()
+	hc.Do(ctx, "tom")
+	time.Sleep(50 * time.Millisecond)
+	hc.Do(ctx, "tom")
+
+	findSpans := func(name string) []*testtrace.Span {
+		var spans []*testtrace.Span
+		for _, span := range tracer.Spans() {
+			if span.Name() == name {
+				spans = append(spans, span)
+			}
+		}
+		return spans
+	}
+	attr := func(span *testtrace.Span, key string) string {
+		return span.Attributes()[kv.Key(key)].AsString()
+	}
+
+	dos := findSpans(spanDo)
+	if len(dos) != 2 {
+		t.Fatal("expect 2 do spans, got: ", len(dos))
+	}
+	for i, outcome := range []MetricType{MMiss, MHit} {
+		if attr(dos[i], attrKeyOutcome) != string(outcome) || attr(dos[i], attrKeyKey) != "tom-tracing" {
+			t.Fatal("unexpected do span attributes: ", dos[i].Attributes())
+		}
+		if attr(dos[i], attrKeyName) != "tracing" || !dos[i].Ended() {
+			t.Fatal("unexpected do span: ", dos[i].Attributes())
+		}
+	}
+
+	// 子 span
+	childOf := func(name string, parent *testtrace.Span) bool {
+		for _, span := range findSpans(name) {
+			if span.ParentSpanID() == parent.SpanContext().SpanID {
+				return true
+			}
+		}
+		return false
+	}
+	if !childOf(spanStorageGet, dos[0]) || !childOf(spanFnRun, dos[0]) {
+		t.Fatal("expect get and fn run spans in miss")
+	}
+	if !childOf(spanStorageGet, dos[1]) || !childOf(spanDecode, dos[1]) || childOf(spanFnRun, dos[1]) {
+		t.Fatal("expect get and decode spans in hit")
+	}
+
+	// 后台更新的 span 链接到触发更新的请求
+	refreshes := findSpans(spanRefresh)
+	if len(refreshes) != 1 {
+		t.Fatal("expect 1 refresh span, got: ", len(refreshes))
+	}
+	if _, ok := refreshes[0].Links()[dos[0].SpanContext()]; !ok {
+		t.Fatal("expect refresh span linked to do span")
+	}
+	if refreshes[0].SpanContext().TraceID == dos[0].SpanContext().TraceID {
+		t.Fatal("expect refresh span in new trace")
+	}
+	if !childOf(spanStorageSet, refreshes[0]) {
+		t.Fatal("expect set span in refresh")
+	}
+}
+
+func TestTyped_Do(t *testing.T) {
+	var runs int32
+	hc, err := NewTyped(&TypedOptions[string, *Foo]{
+		Options: Options{
+			Storage: &LocalStorage{Data: make(map[string]*Value)},
+		},
+		Fn: func(ctx context.Context, name string) (*Foo, error) {
+			atomic.AddInt32(&runs, 1)
+			return &Foo{Bar: name}, nil
+		},
+		GenKeyFn: func(name string) string { return name + "typed" },
+	})
+	if err != nil {
+		t.Fatal("init typed ha-cache error: ", err)
+	}
+
+	jack, err := hc.Do(context.Background(), "jack")
+	if err != nil || jack.Bar != "jack" {
+		t.Fatal("typed do error: ", err, jack)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	jack2, err := hc.Do(context.Background(), "jack")
+	if err != nil || jack2.Bar != "jack" {
+		t.Fatal("typed cached value error: ", err, jack2)
+	}
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatal("expect fn run once, got: ", n)
+	}
+	if key := hc.GenCacheKey("jack"); key != "jacktyped" {
+		t.Fatal("typed gen cache key error: ", key)
+	}
+}
+
+func TestTyped_Error(t *testing.T) {
+	errNotFound := fmt.Errorf("not found")
+	hc, err := NewTyped(&TypedOptions[int, string]{
+		Options: Options{
+			Storage: &LocalStorage{Data: make(map[string]*Value)},
+		},
+		Fn: func(ctx context.Context, id int) (string, error) {
+			if id < 0 {
+				return "", errNotFound
+			}
+			return strconv.Itoa(id), nil
+		},
+		GenKeyFn: func(id int) string { return strconv.Itoa(id) + "typed-err" },
+	})
+	if err != nil {
+		t.Fatal("init typed ha-cache error: ", err)
+	}
+
+	if _, err := hc.Do(context.Background(), -1); err != errNotFound {
+		t.Fatal("expect fn error, got: ", err)
+	}
+
+	v, err := hc.Do(context.Background(), 42)
+	if err != nil || v != "42" {
+		t.Fatal("typed do error: ", err, v)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	v, err = hc.Do(context.Background(), 42)
+	if err != nil || v != "42" {
+		t.Fatal("typed cached value error: ", err, v)
+	}
+}
+
+// nolint: errcheck
+func TestHaCache_DoMulti(t *testing.T) {
+	var batchArgs [][]interface{}
+	var mu sync.Mutex
+	store := &MultiLocalStorage{LocalStorage: LocalStorage{Data: make(map[string]*Value)}}
+	hc, err := New(&Options{
+		Storage:  store,
+		GenKeyFn: func(name string) string { return name + "-multi" },
+		Fn:       fn2,
+		BatchFn: func(ctx context.Context, argsList [][]interface{}) map[string]*FnResult {
+			mu.Lock()
+			batchArgs = append(batchArgs, argsList...)
+			mu.Unlock()
+			results := make(map[string]*FnResult)
+			for _, args := range argsList {
+				name := args[0].(string)
+				results[name+"-multi"] = &FnResult{Val: &Foo{Bar: name}}
+			}
+			return results
+		},
+		Encoder: &MyEncoder{},
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	hc.Do(context.Background(), "b")
+	time.Sleep(50 * time.Millisecond)
+
+	argsList := [][]interface{}{{"a"}, {"b"}, {"c"}, {"a"}}
+	results, err := hc.DoMulti(context.Background(), argsList)
+	if err != nil {
+		t.Fatal("do multi error: ", err)
+	}
+	for i, res := range results {
+		foo, ok := res.Val.(*Foo)
+		if res.Err != nil || !ok || foo.Bar != argsList[i][0].(string) {
+			t.Fatal("do multi result error: ", i, res.Val, res.Err)
+		}
+		if cached := i == 1; foo.Cached != cached {
+			t.Fatal("do multi cached flag error: ", i, foo.Cached)
+		}
+	}
+	if len(batchArgs) != 2 || batchArgs[0][0] != "a" || batchArgs[1][0] != "c" {
+		t.Fatal("expect batch fn run with [a c], got: ", batchArgs)
+	}
+	if store.MGetTimes != 1 {
+		t.Fatal("expect mget once, got: ", store.MGetTimes)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	results, _ = hc.DoMulti(context.Background(), argsList)
+	for i, res := range results {
+		if foo, ok := res.Val.(*Foo); !ok || !foo.Cached {
+			t.Fatal("expect cached value: ", i, res.Val, res.Err)
+		}
+	}
+	if len(batchArgs) != 2 {
+		t.Fatal("expect no more batch fn run, got: ", batchArgs)
+	}
+}
+
+func TestTyped_DoMulti(t *testing.T) {
+	hc, err := NewTyped(&TypedOptions[int, string]{
+		Options: Options{
+			Storage: &LocalStorage{Data: make(map[string]*Value)},
+		},
+		Fn: func(ctx context.Context, id int) (string, error) {
+			return strconv.Itoa(id), nil
+		},
+		GenKeyFn: func(id int) string { return strconv.Itoa(id) + "-typed-multi" },
+		BatchFn: func(ctx context.Context, ids []int) (map[string]string, error) {
+			results := make(map[string]string)
+			for _, id := range ids {
+				// 负数 id 不返回结果
+				if id >= 0 {
+					results[strconv.Itoa(id)+"-typed-multi"] = strconv.Itoa(id)
+				}
+			}
+			return results, nil
+		},
+	})
+	if err != nil {
+		t.Fatal("init typed ha-cache error: ", err)
+	}
+
+	vals, errs := hc.DoMulti(context.Background(), []int{1, -1, 2})
+	if vals[0] != "1" || vals[2] != "2" || errs[0] != nil || errs[2] != nil {
+		t.Fatal("typed do multi error: ", vals, errs)
+	}
+	if errs[1] != ErrorBatchResultMissing {
+		t.Fatal("expect batch result missing error, got: ", errs[1])
+	}
+}
+
+// nolint: errcheck
+func TestHaCache_InvalidateTagDuringFn(t *testing.T) {
+	var hc *HaCache
+	var runs int32
+	// 第一次执行原函数期间 tag 被失效，写入的缓存值应该按 tag 失效处理
+	load := func(ctx context.Context, name string) *FnResult {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			if err := hc.InvalidateTag(ctx, "user:"+name); err != nil {
+				t.Error("invalidate tag error: ", err)
+			}
+		}
+		return &FnResult{Val: &Foo{Bar: name}, Tags: []string{"user:" + name}}
+	}
+	var err error
+	hc, err = New(&Options{
+		Storage:  &MultiLocalStorage{LocalStorage: LocalStorage{Data: make(map[string]*Value)}},
+		GenKeyFn: func(name string) string { return name + "-tag-during-fn" },
+		Fn: func(ctx context.Context, name string) *FnResult {
+			return load(ctx, name)
+		},
+		BatchFn: func(ctx context.Context, argsList [][]interface{}) map[string]*FnResult {
+			results := make(map[string]*FnResult)
+			for _, args := range argsList {
+				name := args[0].(string)
+				results[name+"-tag-during-fn"] = load(ctx, name)
+			}
+			return results
+		},
+		Encoder: &MyEncoder{},
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	ctx := context.Background()
+	hc.Do(ctx, "tom")
+	time.Sleep(50 * time.Millisecond)
+	if v, _ := hc.Do(ctx, "tom"); v.(*Foo).Cached {
+		t.Fatal("expect value cached during tag invalidation to be invalid, got: ", v)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if v, _ := hc.Do(ctx, "tom"); !v.(*Foo).Cached {
+		t.Fatal("expect cached value after refresh, got: ", v)
+	}
+
+	atomic.StoreInt32(&runs, 0)
+	hc.DoMulti(ctx, [][]interface{}{{"jerry"}})
+	time.Sleep(50 * time.Millisecond)
+	if results, _ := hc.DoMulti(ctx, [][]interface{}{{"jerry"}}); results[0].Val.(*Foo).Cached {
+		t.Fatal("expect batch value cached during tag invalidation to be invalid, got: ", results[0].Val)
+	}
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Fatal("expect batch fn run 2 times, got: ", n)
+	}
+}
+
+// nolint: errcheck
+func TestStats_PrometheusSameName(t *testing.T) {
+	ctx := context.Background()
+	for _, suffix := range []string{"-same-name-1", "-same-name-2"} {
+		suffix := suffix
+		hc, err := New(&Options{
+			Name:     "same-name",
+			Storage:  &LocalStorage{Data: make(map[string]*Value)},
+			GenKeyFn: func(name string) string { return name + suffix },
+			Fn:       func(name string) *FnResult { return &FnResult{Val: &Foo{Bar: name}} },
+			Encoder:  &MyEncoder{},
+		})
+		if err != nil {
+			t.Fatal("init hacache error: ", err)
+		}
+		defer hc.Close(ctx)
+		hc.Do(ctx, "tom")
+	}
+
+	w := httptest.NewRecorder()
+	CurrentStats.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, prefix := range []string{
+		`hacache_fn_run_total{name="same-name"} `,
+		`hacache_fn_run_concurrency{name="same-name"} `,
+		`hacache_fn_run_duration_seconds_count{name="same-name"} `,
+	} {
+		if n := strings.Count(body, prefix); n != 1 {
+			t.Fatalf("expect one series %q, got %d in:\n%s", prefix, n, body)
+		}
+	}
+	for _, line := range []string{
+		`hacache_fn_run_total{name="same-name"} 2`,
+		`hacache_fn_run_duration_seconds_count{name="same-name"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("expect line %q in:\n%s", line, body)
+		}
+	}
+}
+
+type TaggedFoo struct {
+	Tags []string
+}
+
+func TestHaCache_L1Mutation(t *testing.T) {
+	ctx := context.Background()
+
+	slices := &CountLocalStorage{LocalStorage: LocalStorage{Data: make(map[string]*Value)}}
+	sliceCache, err := NewTyped(&TypedOptions[string, []string]{
+		Options: Options{Storage: slices, L1Size: 10, L1TTL: time.Hour},
+		Fn: func(ctx context.Context, name string) ([]string, error) {
+			return []string{name}, nil
+		},
+		GenKeyFn: func(name string) string { return name + "-l1-slice" },
+	})
+	if err != nil {
+		t.Fatal("init typed ha-cache error: ", err)
+	}
+	sliceCache.Do(ctx, "tom")
+	time.Sleep(50 * time.Millisecond)
+
+	// L1 中保存序列化之后的值，修改返回值不影响之后的调用
+	for i := 0; i < 3; i++ {
+		v, err := sliceCache.Do(ctx, "tom")
+		if err != nil || len(v) != 1 || v[0] != "tom" {
+			t.Fatal("unexpected value: ", v, err)
+		}
+		v[0] = "mutated"
+	}
+	if n := atomic.LoadInt32(&slices.GetTimes); n != 1 {
+		t.Fatal("expect 1 storage get, got: ", n)
+	}
+	if n := atomic.LoadInt64(&sliceCache.Stats().L1Hit); n != 3 {
+		t.Fatal("expect 3 l1 hits, got: ", n)
+	}
+
+	// 指针指向的 struct 中的 slice 同样不共享
+	structCache, err := NewTyped(&TypedOptions[string, *TaggedFoo]{
+		Options: Options{Storage: &LocalStorage{Data: make(map[string]*Value)}, L1Size: 10, L1TTL: time.Hour},
+		Fn: func(ctx context.Context, name string) (*TaggedFoo, error) {
+			return &TaggedFoo{Tags: []string{name}}, nil
+		},
+		GenKeyFn: func(name string) string { return name + "-l1-struct" },
+	})
+	if err != nil {
+		t.Fatal("init typed ha-cache error: ", err)
+	}
+	structCache.Do(ctx, "tom")
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		v, err := structCache.Do(ctx, "tom")
+		if err != nil || len(v.Tags) != 1 || v.Tags[0] != "tom" {
+			t.Fatal("unexpected value: ", v, err)
+		}
+		v.Tags[0] = "mutated"
+	}
+	if n := atomic.LoadInt64(&structCache.Stats().L1Hit); n != 3 {
+		t.Fatal("expect 3 l1 hits, got: ", n)
+	}
+}
+
+// nolint: errcheck
+func TestStats_LimiterAggregateSink(t *testing.T) {
+	gate := make(chan struct{})
+	hc, err := New(&Options{
+		Name:     "limiter-aggregate-sink",
+		Storage:  &LocalStorage{Data: make(map[string]*Value)},
+		GenKeyFn: func(name string) string { return name + "-limiter-aggregate-sink" },
+		Fn: func(name string) *FnResult {
+			<-gate
+			return &FnResult{Val: &Foo{Bar: name}}
+		},
+		Encoder:    &MyEncoder{},
+		FnRunLimit: 1,
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+	// 只设置汇总统计的 sink，不修改全局的 CurrentStats
+	sink := metrics.NewMemorySink()
+	aggregate := newAggregateStats()
+	aggregate.sink = sink
+	hc.stats.parent = aggregate
+
+	ctx := context.Background()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hc.Do(ctx, "tom")
+	}()
+	name := metrics.T("name", "limiter-aggregate-sink")
+	for i := 0; i < 100 && sink.GaugeValue("limiter-concurrency", name) != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if v := sink.GaugeValue("limiter-concurrency", name); v != 1 {
+		t.Fatal("expect limiter concurrency 1, got: ", v)
+	}
+
+	if _, err := hc.Do(ctx, "jerry"); err != ErrorFnRunLimited {
+		t.Fatal("expect fn run limited, got: ", err)
+	}
+	if v := sink.Counter("limiter-rejected", name); v != 1 {
+		t.Fatal("expect 1 limiter rejection, got: ", v)
+	}
+	close(gate)
+	<-done
+}
+
+// nolint: errcheck
+func TestHaCache_ContextCancelLimit(t *testing.T) {
+	var current, peak int32
+	hc, err := New(&Options{
+		FnRunLimit: 1,
+		Storage:    &LocalStorage{Data: make(map[string]*Value)},
+		GenKeyFn:   func(name string) string { return name + "-cancel-limit" },
+		// 原函数不响应 ctx 取消
+		Fn: func(name string) *FnResult {
+			n := atomic.AddInt32(&current, 1)
+			defer atomic.AddInt32(&current, -1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(200 * time.Millisecond)
+			return &FnResult{Val: name}
+		},
+		Encoder: &TypedEncoder[string]{},
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+
+	// 调用方超时返回后原函数仍在执行，并发额度不释放，其他调用被限流
+	var limited int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if _, err := hc.Do(ctx, strconv.Itoa(i)); err == ErrorFnRunLimited {
+				atomic.AddInt32(&limited, 1)
+			}
+		}(i)
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+	time.Sleep(300 * time.Millisecond)
+
+	if p := atomic.LoadInt32(&peak); p != 1 {
+		t.Fatal("expect peak fn concurrency 1, got: ", p)
+	}
+	if n := atomic.LoadInt32(&limited); n == 0 {
+		t.Fatal("expect calls limited while fn is running")
+	}
+	if n := hc.fnRunLimiter.GetCurrent(); n != 0 {
+		t.Fatal("fn run limiter slot not released: ", n)
+	}
+}
+
+// nolint: errcheck
+func TestStats_CloseAggregateSink(t *testing.T) {
+	hc, err := New(&Options{
+		Name:     "close-aggregate-sink",
+		Storage:  &LocalStorage{Data: make(map[string]*Value)},
+		GenKeyFn: func(name string) string { return name + "-close-aggregate-sink" },
+		Fn:       func(name string) *FnResult { return &FnResult{Val: &Foo{Bar: name}} },
+		Encoder:  &MyEncoder{},
+	})
+	if err != nil {
+		t.Fatal("init hacache error: ", err)
+	}
+	// 只设置汇总统计的 sink，不修改全局的 CurrentStats
+	sink := metrics.NewMemorySink()
+	aggregate := newAggregateStats()
+	aggregate.sink = sink
+	hc.stats.parent = aggregate
+
+	ctx := context.Background()
+	hc.Do(ctx, "tom")
+	hc.Do(ctx, "jerry")
+	// 关闭时上报最后一次数据到汇总统计的 sink
+	hc.Close(ctx)
+
+	name := metrics.T("name", "close-aggregate-sink")
+	if v := sink.Counter("ha-cache", metrics.T("m", string(MFnRun)), name); v != 2 {
+		t.Fatal("expect fn run 2, got: ", v)
+	}
+	for _, instance := range CurrentStats.instances() {
+		if instance == hc.Stats() {
+			t.Fatal("expect closed instance unregistered")
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package hacache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// TimingMetricType 耗时、时长分布指标类型
+type TimingMetricType string
+
+const (
+	// TMFnRun 原函数执行耗时
+	TMFnRun TimingMetricType = "fn-run-duration"
+	// TMStorageGet Storage 读取耗时
+	TMStorageGet TimingMetricType = "storage-get-duration"
+	// TMStorageSet Storage 写入耗时
+	TMStorageSet TimingMetricType = "storage-set-duration"
+	// TMEncode 序列化耗时
+	TMEncode TimingMetricType = "encode-duration"
+	// TMDecode 反序列化耗时
+	TMDecode TimingMetricType = "decode-duration"
+	// TMStaleness 返回的缓存值距离写入的时长（now - CreateTS）
+	TMStaleness TimingMetricType = "staleness"
+)
+
+var (
+	// latencyBuckets 耗时分布的 bucket 上界/s
+	latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// stalenessBuckets 缓存值时长分布的 bucket 上界/s
+	stalenessBuckets = []float64{1, 5, 10, 30, 60, 300, 600, 1800, 3600, 3 * 3600, 6 * 3600, 12 * 3600, 24 * 3600}
+)
+
+// timingBuckets 每种指标使用的 bucket
+func timingBuckets(m TimingMetricType) []float64 {
+	if m == TMStaleness {
+		return stalenessBuckets
+	}
+	return latencyBuckets
+}
+
+// timingMetrics 所有的耗时、时长分布指标
+var timingMetrics = []TimingMetricType{TMFnRun, TMStorageGet, TMStorageSet, TMEncode, TMDecode, TMStaleness}
+
+// timing 记录从 start 开始的耗时
+func (hc *HaCache) timing(m TimingMetricType, start time.Time) {
+	hc.stats.Timing(m, time.Since(start))
+}
+
+// staleness 记录返回的缓存值距离写入的时长
+func (hc *HaCache) staleness(value *CachedValue) {
+	hc.stats.Timing(TMStaleness, time.Since(time.Unix(value.CreateTS, 0)))
+}
+
+// Histogram 固定 bucket 的分布统计，与 Prometheus histogram 语义一致，只增不减
+type Histogram struct {
+	mu sync.Mutex
+	// buckets bucket 上界/s，升序
+	buckets []float64
+	// counts 落在每个 bucket 内的数量，最后一个为 +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram 创建分布统计，buckets 为升序的上界/s
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe 记录一个值
+func (h *Histogram) Observe(d time.Duration) {
+	v := d.Seconds()
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// HistogramSnapshot 分布统计的累计值
+type HistogramSnapshot struct {
+	// Buckets bucket 上界/s
+	Buckets []float64
+	// Counts 小于等于对应上界的累计数量，与 Buckets 一一对应
+	Counts []uint64
+	// Sum 所有值的和/s
+	Sum float64
+	// Count 所有值的数量
+	Count uint64
+}
+
+// Snapshot 获取累计值
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts := make([]uint64, len(h.buckets))
+	var cumulative uint64
+	for i := range h.buckets {
+		cumulative += h.counts[i]
+		counts[i] = cumulative
+	}
+	return HistogramSnapshot{
+		Buckets: h.buckets,
+		Counts:  counts,
+		Sum:     h.sum,
+		Count:   h.count,
+	}
+}
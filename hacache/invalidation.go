@@ -0,0 +1,49 @@
+package hacache
+
+import (
+	"context"
+	"fmt"
+)
+
+// invalidationChannelPrefix 失效广播的 channel 前缀，Name 相同的实例订阅同一个 channel
+const invalidationChannelPrefix = "__hacache_invalidation__:"
+
+// invalidationChannel 当前实例的失效广播 channel
+func (hc *HaCache) invalidationChannel() string {
+	return invalidationChannelPrefix + hc.stats.Name
+}
+
+// subscribeInvalidation 订阅其他实例广播的失效，收到后删除 L1 中的缓存值
+// 重新订阅时清空 L1，避免断开期间丢失的失效消息导致继续返回旧数据；没有开启 L1 时不需要订阅
+func (hc *HaCache) subscribeInvalidation() {
+	if hc.opt.InvalidationBus == nil || hc.l1 == nil {
+		return
+	}
+
+	unsubscribe, err := hc.opt.InvalidationBus.Subscribe(hc.invalidationChannel(), hc.l1.delete, hc.l1.purge)
+	if err != nil {
+		hc.logger.Warn(fmt.Sprintf("hacache subscribe invalidation of %s failed: %v", hc.stats.Name, err))
+		return
+	}
+	hc.unsubscribe = unsubscribe
+}
+
+// unsubscribeInvalidation 取消订阅
+func (hc *HaCache) unsubscribeInvalidation() {
+	if hc.unsubscribe == nil {
+		return
+	}
+	if err := hc.unsubscribe(); err != nil {
+		hc.logger.Warn(fmt.Sprintf("hacache unsubscribe invalidation of %s failed: %v", hc.stats.Name, err))
+	}
+}
+
+// publishInvalidation 广播 key 失效，广播失败时其他实例 L1 中的缓存值在 L1TTL 后过期
+func (hc *HaCache) publishInvalidation(ctx context.Context, key string) {
+	if hc.opt.InvalidationBus == nil {
+		return
+	}
+	if err := hc.opt.InvalidationBus.Publish(ctx, hc.invalidationChannel(), key); err != nil {
+		hc.logger.Warn(fmt.Sprintf("hacache publish invalidation of %s failed: %v", key, err))
+	}
+}
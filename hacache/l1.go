@@ -0,0 +1,212 @@
+package hacache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// l1Entry L1 中的缓存值
+type l1Entry struct {
+	key   string
+	value *CachedValue
+	// expireAt 在 L1 中的过期时间，与缓存值本身的有效期无关
+	expireAt time.Time
+}
+
+// l1Cache 进程内的 LRU 缓存，保存从 storage 读取或者写入 storage 的缓存值，减少 storage 请求
+type l1Cache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// newL1Cache 创建最多保存 size 个缓存值的 L1，size <= 0 时返回 nil
+func newL1Cache(size int, ttl time.Duration) *l1Cache {
+	if size <= 0 {
+		return nil
+	}
+	return &l1Cache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// get 读取 L1 中没有过期的缓存值
+func (c *l1Cache) get(key string, now time.Time) (*CachedValue, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*l1Entry)
+	if now.After(entry.expireAt) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.value, true
+}
+
+// set 写入 L1，超过容量时淘汰最久没有访问的缓存值
+func (c *l1Cache) set(key string, value *CachedValue) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expireAt := time.Now().Add(c.ttl)
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*l1Entry)
+		entry.value, entry.expireAt = value, expireAt
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&l1Entry{key: key, value: value, expireAt: expireAt})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// delete 删除 L1 中的缓存值
+func (c *l1Cache) delete(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// purge 清空 L1
+func (c *l1Cache) purge() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element, c.size)
+	c.lru.Init()
+}
+
+// remove 删除 elem，需要持有锁
+func (c *l1Cache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*l1Entry).key)
+}
+
+// lookup 读取缓存值及其状态，先读 L1，L1 中没有在有效期内的缓存值时读 storage
+// L1 只返回在有效期内的缓存值，过期的缓存值可能已经被其他进程更新，需要重新读取 storage
+func (hc *HaCache) lookup(ctx context.Context, key string) (*CachedValue, cacheState, error) {
+	now := time.Now()
+	if hc.l1 != nil {
+		if value, ok := hc.l1.get(key, now); ok {
+			if state := hc.state(value, now); state == stateFresh || state == stateEarlyRefresh {
+				hc.stats.Incr(ML1Hit, 1)
+				return value, state, nil
+			}
+			hc.l1.delete(key)
+		}
+		hc.stats.Incr(ML1Miss, 1)
+	}
+
+	value, err := hc.Get(ctx, key)
+	if err != nil {
+		return nil, stateInvalid, err
+	}
+	hc.stats.Incr(ML2Hit, 1)
+	state := hc.state(value, now)
+	// 负缓存没有需要反序列化的值，直接写入 L1
+	if value.negative() && (state == stateFresh || state == stateEarlyRefresh) {
+		hc.setL1(key, value)
+	}
+	return value, state, nil
+}
+
+// lookupMulti 批量读取缓存值，返回值与 keys 一一对应，先读 L1，L1 中没有在有效期内的缓存值的 key 一次性读取 storage
+func (hc *HaCache) lookupMulti(ctx context.Context, keys []string) ([]*CachedValue, error) {
+	if hc.l1 == nil {
+		values, err := hc.GetMulti(ctx, keys)
+		if err == nil {
+			hc.countL2Hits(values)
+		}
+		return values, err
+	}
+
+	now := time.Now()
+	values := make([]*CachedValue, len(keys))
+	var missKeys []string
+	var missIdx []int
+	for i, key := range keys {
+		if value, ok := hc.l1.get(key, now); ok {
+			if state := hc.state(value, now); state == stateFresh || state == stateEarlyRefresh {
+				hc.stats.Incr(ML1Hit, 1)
+				values[i] = value
+				continue
+			}
+			hc.l1.delete(key)
+		}
+		hc.stats.Incr(ML1Miss, 1)
+		missKeys = append(missKeys, key)
+		missIdx = append(missIdx, i)
+	}
+	if len(missKeys) == 0 {
+		return values, nil
+	}
+
+	loaded, err := hc.GetMulti(ctx, missKeys)
+	if err != nil {
+		return nil, err
+	}
+	hc.countL2Hits(loaded)
+	for j, value := range loaded {
+		values[missIdx[j]] = value
+	}
+	return values, nil
+}
+
+// countL2Hits 统计 storage 中读取到的缓存值
+func (hc *HaCache) countL2Hits(values []*CachedValue) {
+	for _, value := range values {
+		if value != nil {
+			hc.stats.Incr(ML2Hit, 1)
+		}
+	}
+}
+
+// decodeValue 反序列化返回的缓存值，在有效期内的缓存值反序列化成功后写入 L1
+// L1 中保存的是序列化之后的缓存值，每次命中都重新反序列化，调用方修改返回值不会影响 L1 以及其他调用方
+func (hc *HaCache) decodeValue(ctx context.Context, key string, value *CachedValue, state cacheState) (interface{}, error) {
+	v, err := hc.decode(ctx, key, value)
+	if err == nil && !value.inL1 && (state == stateFresh || state == stateEarlyRefresh) {
+		hc.setL1(key, value)
+	}
+	return v, err
+}
+
+// setL1 写入 L1，保存缓存值的拷贝
+func (hc *HaCache) setL1(key string, value *CachedValue) {
+	if hc.l1 == nil {
+		return
+	}
+
+	cv := *value
+	cv.inL1 = true
+	hc.l1.set(key, &cv)
+}
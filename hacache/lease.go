@@ -0,0 +1,60 @@
+package hacache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// leaseKeyPrefix 后台更新租约的 key 前缀
+const leaseKeyPrefix = "__hacache_lease__:"
+
+// leaseKey 缓存 key 对应的后台更新租约 key
+func leaseKey(key string) string {
+	return leaseKeyPrefix + key
+}
+
+// acquireRefreshLease 获取 key 的后台更新租约，返回 false 说明其他实例正在更新，跳过本次更新
+// 没有设置 RefreshLease 或者获取租约出错时都允许更新，此时返回的 token 为空
+func (hc *HaCache) acquireRefreshLease(ctx context.Context, key string) (string, bool) {
+	if hc.opt.RefreshLease == nil {
+		return "", true
+	}
+
+	token, err := newLeaseToken()
+	if err != nil {
+		hc.logger.Warn(fmt.Sprintf("hacache generate refresh lease token failed: %v", err))
+		return "", true
+	}
+	ok, err := hc.opt.RefreshLease.Acquire(ctx, leaseKey(key), token, hc.opt.RefreshLeaseTTL)
+	if err != nil {
+		// 租约不可用时退化为各自更新，保证缓存能够更新
+		hc.logger.Warn(fmt.Sprintf("hacache acquire refresh lease of %s failed: %v", key, err))
+		return "", true
+	}
+	if !ok {
+		hc.stats.Incr(MRefreshLeaseSkipped, 1)
+		return "", false
+	}
+	return token, true
+}
+
+// releaseRefreshLease 更新结束后释放租约，无论成功与否，其他实例都可以执行下一次更新
+func (hc *HaCache) releaseRefreshLease(ctx context.Context, key, token string) {
+	if token == "" {
+		return
+	}
+	if err := hc.opt.RefreshLease.Release(ctx, leaseKey(key), token); err != nil {
+		hc.logger.Warn(fmt.Sprintf("hacache release refresh lease of %s failed: %v", key, err))
+	}
+}
+
+// newLeaseToken 随机生成租约 token，区分不同实例、不同次的更新
+func newLeaseToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,297 @@
+package hacache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/api/kv"
+)
+
+// multiItem DoMulti 中单个参数的处理状态
+type multiItem struct {
+	args []interface{}
+	key  string
+	// stale 超过最大可接受过期时间的缓存，更新失败时强制返回
+	stale *CachedValue
+}
+
+// DoMulti 批量取缓存结果，返回值与 argsList 一一对应
+// 所有 key 通过一次 Storage 请求读取（Storage 实现了 MultiStorage 时），
+// 缓存 miss 以及超过最大可接受过期时间的参数，一次性传给 Options.BatchFn 执行，
+// 每个参数的有效期、可接受过期、强制更新逻辑与 Do 一致
+func (hc *HaCache) DoMulti(ctx context.Context, argsList [][]interface{}) (_ []*FnResult, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if hc.isClosed() {
+		return nil, ErrorCacheClosed
+	}
+	if hc.opt.BatchFn == nil {
+		return nil, ErrorNoBatchFn
+	}
+
+	ctx, span := hc.startSpan(ctx, spanDoMulti, kv.Int(attrKeyCount, len(argsList)))
+	defer func() { endSpan(ctx, span, err) }()
+
+	results := make([]*FnResult, len(argsList))
+	items := make([]*multiItem, len(argsList))
+	keys := make([]string, 0, len(argsList))
+	for i, args := range argsList {
+		key := hc.GenCacheKey(ctx, args...)
+		switch key {
+		case "":
+			results[i] = &FnResult{Err: ErrorInvalidCacheKey}
+		case SkipCache:
+			// 不缓存的参数无法通过缓存 key 区分批量执行的结果，单独执行原函数
+			hc.stats.Incr(MSkip, 1)
+			res, err := hc.FnRun(ctx, false, args...)
+			if err != nil {
+				res = &FnResult{Err: err}
+			}
+			results[i] = res
+		default:
+			items[i] = &multiItem{args: args, key: key}
+			keys = append(keys, key)
+		}
+	}
+
+	values, err := hc.lookupMulti(ctx, keys)
+	if err != nil {
+		// 与 Do 一致，取缓存出错时穿透到原函数
+		values = make([]*CachedValue, len(keys))
+	}
+
+	var loads []*multiItem
+	now := time.Now()
+	tagsValid := hc.checkTags(ctx, values)
+	j := 0
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+
+		value, tagValid := values[j], tagsValid[j]
+		j++
+		state := stateInvalid
+		if value != nil {
+			state = hc.state(value, now)
+			// 负缓存没有可接受的过期时间，过期后按缓存 miss 处理
+			if value.negative() && state != stateFresh && state != stateEarlyRefresh {
+				value = nil
+			}
+		}
+		if value == nil {
+			hc.stats.Incr(MMiss, 1)
+			loads = append(loads, item)
+			continue
+		}
+
+		if value.negative() {
+			hc.stats.Incr(MNegativeHit, 1)
+			results[i] = negativeResult(value.negativeErr())
+			continue
+		}
+
+		if state != stateInvalid && !tagValid {
+			hc.stats.Incr(MTagInvalid, 1)
+			state = stateInvalid
+		}
+
+		switch state {
+		case stateFresh:
+			hc.stats.Incr(MHit, 1)
+			results[i] = hc.decodeResult(ctx, item.key, value, state)
+			if hc.undecodable(results[i].Err) {
+				results[i] = nil
+				loads = append(loads, item)
+			}
+		case stateInvalid:
+			hc.stats.Incr(MMissInvalid, 1)
+			item.stale = value
+			loads = append(loads, item)
+		default:
+			if state == stateEarlyRefresh {
+				hc.stats.Incr(MHit, 1)
+				hc.stats.Incr(MEarlyRefresh, 1)
+			} else {
+				hc.stats.Incr(MMissExpired, 1)
+			}
+			results[i] = hc.decodeResult(ctx, item.key, value, state)
+			if hc.undecodable(results[i].Err) {
+				results[i] = nil
+				loads = append(loads, item)
+			} else if results[i].Err == nil {
+				hc.Trigger(&EventCacheExpired{
+					Args:        item.args,
+					Key:         item.key,
+					SpanContext: spanContext(ctx),
+				})
+			}
+		}
+	}
+
+	if len(loads) == 0 {
+		return results, nil
+	}
+
+	loaded, err := hc.fnRunBatch(ctx, loads)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+
+	for i, item := range items {
+		if item == nil || results[i] != nil {
+			continue
+		}
+
+		res := loaded[item.key]
+		if err == nil && res == nil {
+			res = &FnResult{Err: ErrorBatchResultMissing}
+		}
+
+		// 触发限流、或者原函数执行错误，强制返回过期数据
+		if err != nil || res.Err != nil {
+			if item.stale != nil {
+				if stale := hc.decodeResult(ctx, item.key, item.stale, stateInvalid); !hc.undecodable(stale.Err) {
+					hc.stats.Incr(MInvalidReturned, 1)
+					results[i] = stale
+					continue
+				}
+			}
+
+			hc.stats.Incr(MFnRunErr, 1)
+			if err != nil {
+				results[i] = &FnResult{Err: err}
+			} else {
+				results[i] = &FnResult{Err: res.Err}
+			}
+			continue
+		}
+
+		if res.NotFound {
+			results[i] = negativeResult(ErrorNotFound)
+			continue
+		}
+		results[i] = &FnResult{Val: res.Val, Tags: res.Tags}
+	}
+
+	return results, nil
+}
+
+// negativeResult 负缓存对应的结果，不存在的结果同时设置 NotFound
+func negativeResult(err error) *FnResult {
+	return &FnResult{Err: err, NotFound: err == ErrorNotFound}
+}
+
+// decodeResult 解析返回的缓存值
+func (hc *HaCache) decodeResult(ctx context.Context, key string, value *CachedValue, state cacheState) *FnResult {
+	hc.staleness(value)
+	v, err := hc.decodeValue(ctx, key, value, state)
+	return &FnResult{Val: v, Err: err}
+}
+
+// fnRunBatch 批量执行原函数，一次批量执行只占用一个并发额度，触发限流返回 ErrorFnRunLimited
+// 执行成功的结果会触发缓存更新，返回缓存 key 到执行结果的映射
+func (hc *HaCache) fnRunBatch(ctx context.Context, items []*multiItem) (_ map[string]*FnResult, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, span := hc.startSpan(ctx, spanBatchFnRun, kv.Int(attrKeyCount, len(items)))
+	defer func() { endSpan(ctx, span, err) }()
+
+	if ok := hc.acquireFnRun(); !ok {
+		hc.releaseFnRun()
+		return nil, ErrorFnRunLimited
+	}
+
+	// 同一个 key 只加载一次
+	seen := make(map[string]bool, len(items))
+	argsList := make([][]interface{}, 0, len(items))
+	for _, item := range items {
+		if !seen[item.key] {
+			seen[item.key] = true
+			argsList = append(argsList, item.args)
+		}
+	}
+
+	start := time.Now()
+	loaded, err := runWithContext(ctx, hc.logger, func() (map[string]*FnResult, error) {
+		defer hc.releaseFnRun()
+		return hc.opt.BatchFn(ctx, argsList), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cost := time.Since(start)
+	hc.stats.Timing(TMFnRun, cost)
+
+	for key, res := range loaded {
+		if res == nil || !hc.cacheable(res) {
+			continue
+		}
+		// 批量执行的耗时记为每个结果的耗时
+		copied := copyResult(res)
+		copied.cost = cost
+		copied.start = start
+		meta, err := hc.newEntryMeta(ctx, copied)
+		if err != nil {
+			hc.logger.Warn(fmt.Sprintf("read tag versions of %s error: %s", key, err))
+			continue
+		}
+		copied.meta = meta
+		hc.Trigger(&EventCacheInvalid{
+			Result:      copied,
+			Key:         key,
+			SpanContext: spanContext(ctx),
+		})
+	}
+	return loaded, nil
+}
+
+// GetMulti 批量获取缓存值，返回值与 keys 一一对应，缓存 miss 的 key 对应 nil
+// Storage 实现了 MultiStorage 时一次请求读取所有 key，否则逐个读取
+func (hc *HaCache) GetMulti(ctx context.Context, keys []string) ([]*CachedValue, error) {
+	values := make([]*CachedValue, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	bs, err := hc.mget(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, b := range bs {
+		if b == nil {
+			continue
+		}
+		if v, err := decodeCachedValue(b); err == nil {
+			values[i] = v
+		}
+	}
+	return values, nil
+}
+
+// mget 批量读取 storage，返回值与 keys 一一对应，不存在的 key 对应 nil
+// Storage 实现了 MultiStorage 时一次请求读取所有 key，否则逐个读取
+func (hc *HaCache) mget(ctx context.Context, keys []string) (_ [][]byte, err error) {
+	ctx, span := hc.startSpan(ctx, spanStorageMGet, kv.Int(attrKeyCount, len(keys)))
+	defer func() { endSpan(ctx, span, err) }()
+	defer hc.timing(TMStorageGet, time.Now())
+
+	if ms, ok := hc.opt.Storage.(MultiStorage); ok {
+		return ms.MGet(ctx, keys)
+	}
+
+	bs := make([][]byte, len(keys))
+	for i, key := range keys {
+		b, err := hc.opt.Storage.Get(ctx, key)
+		if err == nil {
+			bs[i] = b
+		} else if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+	}
+	return bs, nil
+}
@@ -0,0 +1,49 @@
+package hacache
+
+// CachedError 从负缓存中取出的原函数 error，只保留了 error 信息
+type CachedError struct {
+	Msg string
+}
+
+// Error implements error
+func (e *CachedError) Error() string {
+	return e.Msg
+}
+
+// negative 是否是负缓存（不存在的结果或者原函数返回的 error）
+func (v *CachedValue) negative() bool {
+	return v.NotFound || v.Err != ""
+}
+
+// negativeErr 负缓存对应的 error
+func (v *CachedValue) negativeErr() error {
+	if v.NotFound {
+		return ErrorNotFound
+	}
+	return &CachedError{Msg: v.Err}
+}
+
+// cacheable 原函数的执行结果是否需要写入缓存
+// 不存在的结果、CacheableErr 允许缓存的 error，只有开启了负缓存（NegativeExpiration > 0）才写入缓存
+func (hc *HaCache) cacheable(res *FnResult) bool {
+	switch {
+	case res.Ignore:
+		return false
+	case res.Err != nil:
+		return hc.opt.NegativeExpiration > 0 && hc.opt.CacheableErr != nil && hc.opt.CacheableErr(res.Err)
+	case res.NotFound:
+		return hc.opt.NegativeExpiration > 0
+	}
+	return true
+}
+
+// resultValue 原函数执行结果对应的 Do 返回值
+func resultValue(res *FnResult) (interface{}, error) {
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	if res.NotFound {
+		return nil, ErrorNotFound
+	}
+	return res.Val, nil
+}
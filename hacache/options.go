@@ -1,13 +1,20 @@
 package hacache
 
 import (
+	"context"
 	"time"
 
+	"github.com/xiachufang/pkg/v2/metrics"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
 	"go.uber.org/zap"
 )
 
 // Options ha-cache options struct
 type Options struct {
+	// 缓存名称，上报统计数据时作为 name tag，默认为 default
+	Name string
+
 	// 缓存穿透、更新时，执行原函数的最大并发数
 	// 达到了这个最大并发数，说明原函数处理时间比较长，
 	// 有可能是出现某些故障。
@@ -22,29 +29,123 @@ type Options struct {
 	// 缓存过期时间
 	Expiration time.Duration
 
+	// 缓存过期时间随机浮动的比例，取值 [0, 1)，例如 0.1 表示每个缓存的过期时间在 Expiration 的 ±10% 内随机，
+	// 缓存在 storage 中的过期时间同样浮动，避免同时写入的缓存同时过期、同时被淘汰
+	ExpirationJitter float64
+
+	// 提前刷新（XFetch）系数，0 表示不提前刷新，一般设置为 1，越大越容易提前刷新
+	// 缓存有效期内，越接近过期时间、原函数执行耗时越长，越有可能提前触发后台更新，
+	// 避免同时写入的缓存同时过期
+	EarlyRefreshBeta float64
+
+	// 负缓存的过期时间，0 表示不开启负缓存
+	// 开启后原函数返回的不存在结果（FnResult.NotFound）写入缓存，过期后按缓存 miss 处理，没有可接受的过期时间
+	NegativeExpiration time.Duration
+
+	// 原函数返回的 error 是否写入负缓存，需要同时设置 NegativeExpiration
+	// 命中负缓存时 Do 返回 *CachedError，只保留 error 信息
+	CacheableErr func(err error) bool
+
+	// tag 版本的过期时间，需要不小于缓存在 storage 中的过期时间，
+	// 默认为 Expiration + MaxAcceptableExpiration，原函数通过 FnResult 设置了更长的有效期时需要相应调大
+	TagExpiration time.Duration
+
 	// 缓存使用的 storage
 	Storage Storage
 
 	// 生成缓存 key 的函数，函数参数必须与 Fn 一致
+	// 第一个参数为 context.Context 时，会传入 Do 的 ctx
 	GenKeyFn interface{}
 
 	// 被缓存的原函数
+	// 第一个参数为 context.Context 时，会传入 Do 的 ctx
 	Fn interface{}
 
-	// 事件 channel size
+	// 批量执行的原函数，DoMulti 中需要更新的参数一次性传入，
+	// 返回缓存 key（与 GenKeyFn 生成的一致）到执行结果的映射，缺少的 key 视为执行出错
+	BatchFn func(ctx context.Context, argsList [][]interface{}) map[string]*FnResult
+
+	// 事件 channel size，每个 worker 一个 channel
 	EventBufferSize int32
 
+	// 处理缓存更新事件的 worker 数量，同一个 key 的事件总是由同一个 worker 按顺序处理
+	Workers int
+
 	// message encoder
 	Encoder Encoder
 
+	// 缓存值的压缩算法，默认不压缩
+	// 使用的压缩算法记录在缓存值中，修改后仍然可以读取之前写入的缓存值
+	Compression Compression
+
+	// 序列化之后超过多少字节才压缩，默认 1024
+	CompressionThreshold int
+
+	// 缓存值加密使用的密钥，为 nil 时不加密
+	// 设置后缓存值压缩之后使用当前密钥 AES-GCM 加密，读取时按缓存值记录的密钥 ID 解密
+	Keyring *Keyring
+
 	// logger
 	Logger *zap.Logger
+
+	// 进程内 L1 缓存的最大缓存值数量，0 表示不开启
+	// L1 保存反序列化之后的值，只在缓存值的有效期内返回，减少 storage 请求与反序列化
+	L1Size int
+
+	// 缓存值在 L1 中的最长保存时间，默认 1s，超过后重新读取 storage，获取其他进程的更新
+	L1TTL time.Duration
+
+	// 当前实例单独的指标上报，原函数执行并发限制也上报到这里；
+	// 为 nil 时由 CurrentStats.Setup 设置的指标上报统一上报
+	MetricsSink metrics.Sink
+
+	// 后台更新的分布式租约，为 nil 时每个实例各自执行后台更新
+	// 设置后同一个 key 同一时间只有一个实例执行后台更新，其他实例跳过更新，继续返回可接受的过期缓存
+	RefreshLease RefreshLease
+
+	// 后台更新租约的有效期，默认 30s，需要大于原函数执行耗时
+	// 更新结束后立即释放租约，有效期只在持有租约的实例异常退出时生效
+	RefreshLeaseTTL time.Duration
+
+	// 跨实例广播缓存失效，为 nil 时不广播
+	// 设置后 Delete、Invalidate 通过 bus 通知 Name 相同的其他实例，其他实例删除 L1 中的缓存值
+	InvalidationBus InvalidationBus
+
+	// 创建 span 使用的 tracer，默认使用 OpenTelemetry 全局的 tracer
+	Tracer trace.Tracer
 }
 
 // Storage storage is interface of cache
+// ctx 由 HaCache.Do 传入，实现需要在 ctx 取消或超时后尽快返回
 type Storage interface {
-	Get(key string) ([]byte, error)
-	Set(key string, value []byte, expiration time.Duration) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, expiration time.Duration) error
+	// Delete 删除 key，key 不存在时不返回错误
+	Delete(ctx context.Context, key string) error
+}
+
+// MultiStorage 支持批量读取的 storage，DoMulti 时用一次请求读取所有 key
+// 返回值与 keys 一一对应，不存在的 key 对应 nil
+type MultiStorage interface {
+	MGet(ctx context.Context, keys []string) ([][]byte, error)
+}
+
+// RefreshLease 后台更新的分布式租约，同一个 key 同一时间只能被一个 token 持有
+// storage.Redis 实现了该接口
+type RefreshLease interface {
+	// Acquire key 不存在时写入 token，有效期为 ttl，返回是否获取成功
+	Acquire(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	// Release key 的值为 token 时删除 key，租约已经过期或者被其他 token 持有时不做处理
+	Release(ctx context.Context, key, token string) error
+}
+
+// InvalidationBus 跨实例广播消息，storage.Redis 通过 pub/sub 实现了该接口
+type InvalidationBus interface {
+	// Publish 向 channel 广播消息
+	Publish(ctx context.Context, channel, message string) error
+	// Subscribe 订阅 channel，收到消息时调用 onMessage；每次（重新）订阅成功时调用 onSubscribe，
+	// 断开期间的消息可能丢失，返回的函数用于取消订阅
+	Subscribe(channel string, onMessage func(message string), onSubscribe func()) (func() error, error)
 }
 
 // Init setup default value of options
@@ -57,6 +158,10 @@ func (opt *Options) Init() {
 		opt.EventBufferSize = 0
 	}
 
+	if opt.Workers <= 0 {
+		opt.Workers = 1
+	}
+
 	if opt.FnRunLimit == 0 {
 		opt.FnRunLimit = 50
 	}
@@ -69,10 +174,34 @@ func (opt *Options) Init() {
 		opt.Expiration = 3 * time.Hour
 	}
 
+	if opt.ExpirationJitter < 0 || opt.ExpirationJitter >= 1 {
+		opt.ExpirationJitter = 0
+	}
+
+	if opt.TagExpiration == 0 {
+		opt.TagExpiration = time.Duration(float64(opt.Expiration)*(1+opt.ExpirationJitter)) + opt.MaxAcceptableExpiration
+	}
+
+	if opt.L1Size > 0 && opt.L1TTL <= 0 {
+		opt.L1TTL = time.Second
+	}
+
+	if opt.RefreshLease != nil && opt.RefreshLeaseTTL <= 0 {
+		opt.RefreshLeaseTTL = 30 * time.Second
+	}
+
+	if opt.CompressionThreshold <= 0 {
+		opt.CompressionThreshold = defaultCompressionThreshold
+	}
+
 	if opt.Encoder == nil {
 		opt.Encoder = &HaEncoder{}
 	}
 
+	if opt.Tracer == nil {
+		opt.Tracer = global.Tracer(tracerName)
+	}
+
 	if opt.Logger == nil {
 		if l, err := zap.NewProduction(); err == nil {
 			opt.Logger = l
@@ -0,0 +1,175 @@
+package hacache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// prometheusNamespace Prometheus 指标名称前缀
+const prometheusNamespace = "hacache"
+
+// metricHelp Prometheus 指标说明
+var metricHelp = map[string]string{
+	string(MHit):                 "命中有效缓存次数",
+	string(MMiss):                "完全 miss 次数",
+	string(MMissExpired):         "命中过期缓存，但是在可接受过期范围内的次数",
+	string(MEarlyRefresh):        "命中有效缓存，但是提前触发了后台更新的次数",
+	string(MNegativeHit):         "命中负缓存次数",
+	string(ML1Hit):               "命中 L1 中有效缓存次数",
+	string(ML1Miss):              "L1 中没有有效缓存的次数",
+	string(ML2Hit):               "storage 中读取到缓存值次数",
+	string(MMissInvalid):         "命中过期缓存，在最大可接受失效时间范围外的次数",
+	string(MTagInvalid):          "关联的 tag 已经失效的次数",
+	string(MInvalidReturned):     "强制返回过期缓存次数",
+	string(MFnRun):               "执行原函数次数",
+	string(MFnRunErr):            "原函数执行出错次数",
+	string(MFnRunLimited):        "原函数执行被限流次数",
+	string(MFnRunCoalesced):      "合并到其他请求的原函数执行次数",
+	string(MEventChanBlocked):    "事件 channel block 住的次数",
+	string(MSkip):                "不缓存次数",
+	string(MWorkerPanic):         "worker panic 次数",
+	string(MRefreshLeaseSkipped): "其他实例持有后台更新租约，跳过后台更新的次数",
+	string(MUndecodable):         "缓存值无法解密或者解压，按缓存 miss 处理的次数",
+	string(GMFnRunConcurrency):   "原函数执行并发度",
+	string(GMEventQueueDepth):    "等待 worker 处理的事件数量",
+	string(TMFnRun):              "原函数执行耗时",
+	string(TMStorageGet):         "Storage 读取耗时",
+	string(TMStorageSet):         "Storage 写入耗时",
+	string(TMEncode):             "序列化耗时",
+	string(TMDecode):             "反序列化耗时",
+	string(TMStaleness):          "返回的缓存值距离写入的时长",
+}
+
+// prometheusName 指标在 Prometheus 中的名称，例如 fn-run 对应 hacache_fn_run
+func prometheusName(metric string) string {
+	return prometheusNamespace + "_" + strings.ReplaceAll(metric, "-", "_")
+}
+
+// promSample 一个实例的指标值
+type promSample struct {
+	name  string
+	value int64
+}
+
+// promHistogram 一个实例的分布统计
+type promHistogram struct {
+	name     string
+	snapshot HistogramSnapshot
+}
+
+// ServeHTTP 以 Prometheus text exposition format 输出统计数据，汇总统计输出所有实例的数据
+// 计数器输出累计值，每个实例的数据带上 name label，同名实例的数据累加后输出
+//
+//	http.Handle("/metrics", hacache.CurrentStats)
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := s.WritePrometheus(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// WritePrometheus 以 Prometheus text exposition format 写入统计数据
+func (s *Stats) WritePrometheus(w io.Writer) error {
+	instances := []*Stats{s}
+	if s.isAggregate() {
+		instances = s.instances()
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Name < instances[j].Name
+	})
+
+	counters := make(map[string][]promSample)
+	gauges := make(map[string][]promSample)
+	histograms := make(map[string][]promHistogram)
+	for _, instance := range instances {
+		for m, v := range instance.Snapshot() {
+			counters[string(m)] = addPromSample(counters[string(m)], instance.Name, v)
+		}
+		for m, v := range instance.ExportGauge() {
+			gauges[string(m)] = addPromSample(gauges[string(m)], instance.Name, int64(v))
+		}
+		for m, v := range instance.ExportTimings() {
+			histograms[string(m)] = addPromHistogram(histograms[string(m)], instance.Name, v)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	writePromFamilies(bw, counters, "counter", "_total")
+	writePromFamilies(bw, gauges, "gauge", "")
+	writePromHistograms(bw, histograms)
+	return bw.Flush()
+}
+
+// addPromSample 添加一个实例的指标值，samples 按实例名称有序，同名实例的值累加到一起，避免输出重复的 series
+func addPromSample(samples []promSample, name string, value int64) []promSample {
+	if n := len(samples); n > 0 && samples[n-1].name == name {
+		samples[n-1].value += value
+		return samples
+	}
+	return append(samples, promSample{name, value})
+}
+
+// addPromHistogram 添加一个实例的分布统计，同名实例的分布统计合并到一起，同一个指标的 bucket 都相同
+func addPromHistogram(histograms []promHistogram, name string, snapshot HistogramSnapshot) []promHistogram {
+	n := len(histograms)
+	if n == 0 || histograms[n-1].name != name {
+		return append(histograms, promHistogram{name, snapshot})
+	}
+
+	merged := &histograms[n-1].snapshot
+	counts := make([]uint64, len(merged.Counts))
+	for i := range counts {
+		counts[i] = merged.Counts[i] + snapshot.Counts[i]
+	}
+	merged.Counts = counts
+	merged.Sum += snapshot.Sum
+	merged.Count += snapshot.Count
+	return histograms
+}
+
+// writePromFamilies 按指标名称排序写入一组指标，label 值通过 %q 转义
+func writePromFamilies(w *bufio.Writer, families map[string][]promSample, typ, suffix string) {
+	metrics := make([]string, 0, len(families))
+	for m := range families {
+		metrics = append(metrics, m)
+	}
+	sort.Strings(metrics)
+
+	for _, m := range metrics {
+		name := prometheusName(m) + suffix
+		fmt.Fprintf(w, "# HELP %s %s\n", name, metricHelp[m])
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		for _, sample := range families[m] {
+			fmt.Fprintf(w, "%s{name=%q} %d\n", name, sample.name, sample.value)
+		}
+	}
+}
+
+// writePromHistograms 按指标名称排序写入分布统计，单位为秒
+func writePromHistograms(w *bufio.Writer, families map[string][]promHistogram) {
+	metrics := make([]string, 0, len(families))
+	for m := range families {
+		metrics = append(metrics, m)
+	}
+	sort.Strings(metrics)
+
+	for _, m := range metrics {
+		name := prometheusName(m) + "_seconds"
+		fmt.Fprintf(w, "# HELP %s %s\n", name, metricHelp[m])
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		for _, h := range families[m] {
+			for i, le := range h.snapshot.Buckets {
+				fmt.Fprintf(w, "%s_bucket{name=%q,le=\"%s\"} %d\n",
+					name, h.name, strconv.FormatFloat(le, 'g', -1, 64), h.snapshot.Counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{name=%q,le=\"+Inf\"} %d\n", name, h.name, h.snapshot.Count)
+			fmt.Fprintf(w, "%s_sum{name=%q} %s\n", name, h.name, strconv.FormatFloat(h.snapshot.Sum, 'g', -1, 64))
+			fmt.Fprintf(w, "%s_count{name=%q} %d\n", name, h.name, h.snapshot.Count)
+		}
+	}
+}
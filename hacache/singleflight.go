@@ -0,0 +1,114 @@
+package hacache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// flightCall 正在执行中的原函数调用
+type flightCall struct {
+	done    chan struct{}
+	res     *FnResult
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup 合并同一个缓存 key 并发的原函数调用，同一时刻同一个 key 只有一个调用在执行
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Do 执行 fn 并返回结果，如果 key 已经有调用在执行，等待该调用的结果，shared 为 true
+// 每个调用者的等待时间受自己的 ctx 控制；fn 的 ctx 不继承调用者的取消，
+// 只有在所有调用者都放弃等待后才会被取消
+func (g *flightGroup) Do(
+	ctx context.Context,
+	key string,
+	fn func(ctx context.Context) (*FnResult, error),
+) (res *FnResult, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		c.waiters++
+		g.mu.Unlock()
+		res, err = g.wait(ctx, key, c)
+		return res, true, err
+	}
+
+	fctx, cancel := context.WithCancel(detachedContext{ctx})
+	c := &flightCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	go func() {
+		defer func() {
+			cancel()
+			g.forget(key, c)
+			close(c.done)
+		}()
+		c.res, c.err = fn(fctx)
+	}()
+
+	res, err = g.wait(ctx, key, c)
+	return res, false, err
+}
+
+// wait 等待 c 执行结束，ctx 取消时放弃等待
+func (g *flightGroup) wait(ctx context.Context, key string, c *flightCall) (*FnResult, error) {
+	select {
+	case <-c.done:
+		return c.res, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		last := c.waiters == 0
+		if last {
+			// 没有调用者在等待结果了，取消执行，后续的调用重新发起
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+
+		// fn 收到取消后会立即返回，等待其释放并发限制等资源后再返回
+		if last {
+			<-c.done
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// forget 移除执行结束的调用
+func (g *flightGroup) forget(key string, c *flightCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
+
+// detachedContext 保留 parent 中的 value，但不继承 parent 的取消与超时
+type detachedContext struct {
+	context.Context
+}
+
+// Deadline 没有超时时间
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Done 永远不会被取消
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+// Err 永远返回 nil
+func (detachedContext) Err() error {
+	return nil
+}
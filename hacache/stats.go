@@ -1,10 +1,11 @@
 package hacache
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/smira/go-statsd"
+	"github.com/xiachufang/pkg/v2/metrics"
 )
 
 const defaultExportInterval = 5 * time.Second
@@ -22,8 +23,20 @@ const (
 	MMiss MetricType = "miss"
 	// MMissExpired 命中过期缓存，但是在可接受过期范围内
 	MMissExpired MetricType = "miss-expired"
+	// MEarlyRefresh 命中有效缓存，但是提前触发了后台更新
+	MEarlyRefresh MetricType = "early-refresh"
+	// MNegativeHit 命中负缓存
+	MNegativeHit MetricType = "negative-hit"
+	// ML1Hit 命中 L1 中的有效缓存
+	ML1Hit MetricType = "l1-hit"
+	// ML1Miss L1 中没有有效缓存，读取 storage
+	ML1Miss MetricType = "l1-miss"
+	// ML2Hit storage 中读取到缓存值
+	ML2Hit MetricType = "l2-hit"
 	// MMissInvalid 命中过期缓存，在最大可接受失效时间范围外
 	MMissInvalid MetricType = "miss-invalid"
+	// MTagInvalid 关联的 tag 已经失效
+	MTagInvalid MetricType = "tag-invalid"
 	// MInvalidReturned 强制返回过期缓存
 	MInvalidReturned MetricType = "invalid-returned"
 	// MFnRun 执行原函数
@@ -32,142 +45,435 @@ const (
 	MFnRunErr MetricType = "fn-run-err"
 	// MFnRunLimited 原函数执行被限流
 	MFnRunLimited MetricType = "fn-run-limited"
+	// MFnRunCoalesced 缓存同步更新时，合并到其他请求的原函数执行，没有单独执行原函数
+	MFnRunCoalesced MetricType = "fn-run-coalesced"
 	// MEventChanBlocked 事件 channel block 住
 	MEventChanBlocked MetricType = "event-chan-blocked"
 	// MSkip 不缓存
 	MSkip MetricType = "skip"
+	// MRefreshLeaseSkipped 其他实例持有后台更新租约，跳过后台更新
+	MRefreshLeaseSkipped MetricType = "refresh-lease-skipped"
+	// MUndecodable 缓存值使用未知的密钥或者压缩算法写入，或者解密失败，按缓存 miss 处理
+	MUndecodable MetricType = "undecodable"
 	// MWorkerPanic worker goroutine panic times
 	MWorkerPanic MetricType = "worker-panic"
 	// GMFnRunConcurrency 原函数执行并发度
 	GMFnRunConcurrency GaugeMetricType = "fn-run-concurrency"
+	// GMEventQueueDepth 等待 worker 处理的事件数量
+	GMEventQueueDepth GaugeMetricType = "event-queue-depth"
 )
 
+// defaultStatsName 没有设置 Options.Name 时的缓存名称
+const defaultStatsName = "default"
+
 // Stats 缓存统计数据
+// 每个 HaCache 实例有自己的 Stats，同时汇总到全局的 CurrentStats
 type Stats struct {
+	// 缓存名称，上报时作为 name tag
+	Name string
+
+	// 计数器只增不减，Export 返回上次导出后的增量，Snapshot 返回累计值
 	// 命中有效缓存次数
-	Hit int32
+	Hit int64
 	// 命中失效缓存次数
-	MissExpired int32
+	MissExpired int64
+	// 提前触发后台更新次数
+	EarlyRefresh int64
+	// 命中负缓存次数
+	NegativeHit int64
+	// 命中 L1 次数
+	L1Hit int64
+	// L1 miss 次数
+	L1Miss int64
+	// storage 中读取到缓存值次数
+	L2Hit int64
 	// 命中在最大可接受失效时间范围外的次数
-	MissInvalid int32
+	MissInvalid int64
+	// 关联的 tag 失效次数
+	TagInvalid int64
 	// 强制返回过期缓存次数
-	InvalidReturned int32
+	InvalidReturned int64
 	// 完全 miss
-	Miss int32
+	Miss int64
 	// 原函数执行次数
-	FnRun int32
+	FnRun int64
 	// 原函数执行被限流
-	FnRunLimited     int32
-	FnRunErr         int32
-	EventChanBlocked int32
-	Skip             int32
-	WorkerPanic      int32
+	FnRunLimited int64
+	// 合并到其他请求的原函数执行次数
+	FnRunCoalesced   int64
+	FnRunErr         int64
+	EventChanBlocked int64
+	Skip             int64
+	WorkerPanic      int64
+	// 其他实例持有后台更新租约，跳过后台更新次数
+	RefreshLeaseSkipped int64
+	// 无法解密或者解压的缓存值次数
+	Undecodable int64
 
 	// FnRun 当前执行并发度
 	FnRunConcurrency int32
+	// 等待 worker 处理的事件数量
+	EventQueueDepth int32
+
+	// sink 指标上报，通过 Setup 设置
+	sink metrics.Sink
+	// stop 关闭后停止定时上报
+	stop     chan struct{}
+	stopOnce sync.Once
 
-	Exporter *statsd.Client
+	// parent 汇总统计数据的 Stats
+	parent *Stats
+	// mu 保护 children 和 sink
+	mu sync.RWMutex
+	// children 汇总到当前 Stats 的实例，只有汇总的 Stats 不为 nil
+	children map[*Stats]struct{}
+	// exported 上次 Export 时的累计值
+	exportMu sync.Mutex
+	exported map[MetricType]int64
+	// histograms 耗时、时长分布
+	histogramsOnce sync.Once
+	histograms     map[TimingMetricType]*Histogram
+}
+
+// NewStats 创建缓存实例的统计，统计数据同时汇总到 CurrentStats
+func NewStats(name string) *Stats {
+	if name == "" {
+		name = defaultStatsName
+	}
+	return &Stats{Name: name, parent: CurrentStats, stop: make(chan struct{})}
+}
+
+// newAggregateStats 创建汇总统计
+func newAggregateStats() *Stats {
+	return &Stats{children: make(map[*Stats]struct{}), stop: make(chan struct{})}
+}
+
+// register 注册缓存实例的统计，汇总统计上报时一起上报
+func (s *Stats) register(child *Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.children[child] = struct{}{}
+}
+
+// unregister 取消注册缓存实例的统计
+func (s *Stats) unregister(child *Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.children, child)
+}
+
+// isAggregate 是否是汇总统计
+func (s *Stats) isAggregate() bool {
+	return s.children != nil
+}
+
+// instances 汇总到当前 Stats 的缓存实例统计
+func (s *Stats) instances() []*Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	instances := make([]*Stats, 0, len(s.children))
+	for child := range s.children {
+		instances = append(instances, child)
+	}
+	return instances
 }
 
 // Gauge 设置某项指标 gauge 数据
 func (s *Stats) Gauge(m GaugeMetricType, i int32) {
-	if m == GMFnRunConcurrency {
+	switch m {
+	case GMFnRunConcurrency:
 		atomic.StoreInt32(&s.FnRunConcurrency, i)
+	case GMEventQueueDepth:
+		atomic.StoreInt32(&s.EventQueueDepth, i)
 	}
 }
 
-// Incr 增加某项指标数据
-func (s *Stats) Incr(m MetricType, i int32) {
+// Incr 增加某项指标数据，同时增加汇总数据
+func (s *Stats) Incr(m MetricType, i int64) {
+	if s.parent != nil {
+		s.parent.Incr(m, i)
+	}
+
 	switch m {
 	case MHit:
-		atomic.AddInt32(&s.Hit, i)
+		atomic.AddInt64(&s.Hit, i)
 	case MMiss:
-		atomic.AddInt32(&s.Miss, i)
+		atomic.AddInt64(&s.Miss, i)
 	case MMissExpired:
-		atomic.AddInt32(&s.MissExpired, i)
+		atomic.AddInt64(&s.MissExpired, i)
+	case MEarlyRefresh:
+		atomic.AddInt64(&s.EarlyRefresh, i)
+	case MNegativeHit:
+		atomic.AddInt64(&s.NegativeHit, i)
+	case ML1Hit:
+		atomic.AddInt64(&s.L1Hit, i)
+	case ML1Miss:
+		atomic.AddInt64(&s.L1Miss, i)
+	case ML2Hit:
+		atomic.AddInt64(&s.L2Hit, i)
 	case MMissInvalid:
-		atomic.AddInt32(&s.MissInvalid, i)
+		atomic.AddInt64(&s.MissInvalid, i)
+	case MTagInvalid:
+		atomic.AddInt64(&s.TagInvalid, i)
 	case MFnRun:
-		atomic.AddInt32(&s.FnRun, i)
+		atomic.AddInt64(&s.FnRun, i)
 	case MInvalidReturned:
-		atomic.AddInt32(&s.InvalidReturned, i)
+		atomic.AddInt64(&s.InvalidReturned, i)
 	case MFnRunErr:
-		atomic.AddInt32(&s.FnRunErr, i)
+		atomic.AddInt64(&s.FnRunErr, i)
 	case MFnRunLimited:
-		atomic.AddInt32(&s.FnRunLimited, i)
+		atomic.AddInt64(&s.FnRunLimited, i)
+	case MFnRunCoalesced:
+		atomic.AddInt64(&s.FnRunCoalesced, i)
 	case MEventChanBlocked:
-		atomic.AddInt32(&s.EventChanBlocked, i)
+		atomic.AddInt64(&s.EventChanBlocked, i)
 	case MSkip:
-		atomic.AddInt32(&s.Skip, i)
+		atomic.AddInt64(&s.Skip, i)
 	case MWorkerPanic:
-		atomic.AddInt32(&s.WorkerPanic, i)
+		atomic.AddInt64(&s.WorkerPanic, i)
+	case MRefreshLeaseSkipped:
+		atomic.AddInt64(&s.RefreshLeaseSkipped, i)
+	case MUndecodable:
+		atomic.AddInt64(&s.Undecodable, i)
+	}
+}
+
+// Snapshot 获取计数器的累计值，用于 Prometheus 等拉取方式上报
+func (s *Stats) Snapshot() map[MetricType]int64 {
+	return map[MetricType]int64{
+		MHit:                 atomic.LoadInt64(&s.Hit),
+		MMissExpired:         atomic.LoadInt64(&s.MissExpired),
+		MEarlyRefresh:        atomic.LoadInt64(&s.EarlyRefresh),
+		MNegativeHit:         atomic.LoadInt64(&s.NegativeHit),
+		ML1Hit:               atomic.LoadInt64(&s.L1Hit),
+		ML1Miss:              atomic.LoadInt64(&s.L1Miss),
+		ML2Hit:               atomic.LoadInt64(&s.L2Hit),
+		MMissInvalid:         atomic.LoadInt64(&s.MissInvalid),
+		MTagInvalid:          atomic.LoadInt64(&s.TagInvalid),
+		MMiss:                atomic.LoadInt64(&s.Miss),
+		MFnRun:               atomic.LoadInt64(&s.FnRun),
+		MInvalidReturned:     atomic.LoadInt64(&s.InvalidReturned),
+		MFnRunLimited:        atomic.LoadInt64(&s.FnRunLimited),
+		MFnRunCoalesced:      atomic.LoadInt64(&s.FnRunCoalesced),
+		MFnRunErr:            atomic.LoadInt64(&s.FnRunErr),
+		MEventChanBlocked:    atomic.LoadInt64(&s.EventChanBlocked),
+		MSkip:                atomic.LoadInt64(&s.Skip),
+		MWorkerPanic:         atomic.LoadInt64(&s.WorkerPanic),
+		MRefreshLeaseSkipped: atomic.LoadInt64(&s.RefreshLeaseSkipped),
+		MUndecodable:         atomic.LoadInt64(&s.Undecodable),
+	}
+}
+
+// Export 导出上次导出之后的增量数据，用于 statsd 等推送方式上报
+func (s *Stats) Export() map[MetricType]int64 {
+	s.exportMu.Lock()
+	defer s.exportMu.Unlock()
+
+	snapshot := s.Snapshot()
+	data := make(map[MetricType]int64, len(snapshot))
+	for m, v := range snapshot {
+		data[m] = v - s.exported[m]
+	}
+	s.exported = snapshot
+	return data
+}
+
+// Timing 记录耗时、时长分布，同时记录到汇总数据
+// 设置了指标上报时，每个值都作为 timing 上报
+func (s *Stats) Timing(m TimingMetricType, d time.Duration) {
+	if s.parent != nil {
+		s.parent.Timing(m, d)
+	}
+
+	if h := s.histogram(m); h != nil {
+		h.Observe(d)
+	}
+
+	if sink := s.timingSink(); sink != nil {
+		sink.Timing("ha-cache-timing", d, metrics.T("m", string(m)), metrics.T("name", s.Name))
+	}
+}
+
+// histogram 指标对应的分布统计
+func (s *Stats) histogram(m TimingMetricType) *Histogram {
+	s.histogramsOnce.Do(func() {
+		s.histograms = make(map[TimingMetricType]*Histogram, len(timingMetrics))
+		for _, m := range timingMetrics {
+			s.histograms[m] = NewHistogram(timingBuckets(m))
+		}
+	})
+	return s.histograms[m]
+}
+
+// timingSink 当前实例上报 timing 以及关闭时最后一次上报使用的 sink，没有单独设置时使用汇总统计的 sink，汇总数据不上报
+func (s *Stats) timingSink() metrics.Sink {
+	if s.isAggregate() {
+		return nil
+	}
+	if sink := s.getSink(); sink != nil {
+		return sink
+	}
+	if s.parent != nil {
+		return s.parent.getSink()
+	}
+	return nil
+}
+
+// limiterSink 原函数并发限制的指标上报，与 timing 一样实例没有设置 sink 时使用汇总统计的 sink
+// 每次上报时读取当前的 sink，创建缓存实例之后再设置 CurrentStats 同样生效
+type limiterSink struct {
+	stats *Stats
+}
+
+// Incr implements metrics.Sink
+func (s limiterSink) Incr(name string, value int64, tags ...metrics.Tag) {
+	if sink := s.stats.timingSink(); sink != nil {
+		sink.Incr(name, value, tags...)
 	}
 }
 
-// Export 到处统计数据，并清空
-func (s *Stats) Export() map[MetricType]int32 {
-	return map[MetricType]int32{
-		MHit:              atomic.SwapInt32(&s.Hit, 0),
-		MMissExpired:      atomic.SwapInt32(&s.MissExpired, 0),
-		MMissInvalid:      atomic.SwapInt32(&s.MissInvalid, 0),
-		MMiss:             atomic.SwapInt32(&s.Miss, 0),
-		MFnRun:            atomic.SwapInt32(&s.FnRun, 0),
-		MInvalidReturned:  atomic.SwapInt32(&s.InvalidReturned, 0),
-		MFnRunLimited:     atomic.SwapInt32(&s.FnRunLimited, 0),
-		MFnRunErr:         atomic.SwapInt32(&s.FnRunErr, 0),
-		MEventChanBlocked: atomic.SwapInt32(&s.EventChanBlocked, 0),
-		MSkip:             atomic.SwapInt32(&s.Skip, 0),
-		MWorkerPanic:      atomic.SwapInt32(&s.WorkerPanic, 0),
+// Gauge implements metrics.Sink
+func (s limiterSink) Gauge(name string, value int64, tags ...metrics.Tag) {
+	if sink := s.stats.timingSink(); sink != nil {
+		sink.Gauge(name, value, tags...)
 	}
 }
 
-// ExportGauge 获取 Gauge 数据
+// Timing implements metrics.Sink
+func (s limiterSink) Timing(name string, d time.Duration, tags ...metrics.Tag) {
+	if sink := s.stats.timingSink(); sink != nil {
+		sink.Timing(name, d, tags...)
+	}
+}
+
+// ExportTimings 获取耗时、时长分布的累计值
+func (s *Stats) ExportTimings() map[TimingMetricType]HistogramSnapshot {
+	timings := make(map[TimingMetricType]HistogramSnapshot, len(timingMetrics))
+	for _, m := range timingMetrics {
+		timings[m] = s.histogram(m).Snapshot()
+	}
+	return timings
+}
+
+// ExportGauge 获取 Gauge 数据，汇总统计返回所有实例的和
 func (s *Stats) ExportGauge() map[GaugeMetricType]int32 {
+	if s.isAggregate() {
+		gauges := make(map[GaugeMetricType]int32)
+		for _, child := range s.instances() {
+			for m, v := range child.ExportGauge() {
+				gauges[m] += v
+			}
+		}
+		return gauges
+	}
+
 	return map[GaugeMetricType]int32{
 		GMFnRunConcurrency: atomic.LoadInt32(&s.FnRunConcurrency),
+		GMEventQueueDepth:  atomic.LoadInt32(&s.EventQueueDepth),
 	}
 }
 
-// Run 上报数据
+// Run 定时上报数据，Stop 后退出
+// 汇总统计上报所有实例的数据，每个实例的数据带上缓存名称 tag
 func (s *Stats) Run() {
 	defer func() {
 		if v := recover(); v != nil {
-			s.Exporter.Incr("panic", 1, statsd.StringTag("tag", "hacache-stats"))
+			s.getSink().Incr("panic", 1, metrics.T("tag", "hacache-stats"))
 			s.Run()
 		}
 	}()
 
+	ticker := time.NewTicker(defaultExportInterval)
+	defer ticker.Stop()
 	for {
-		time.Sleep(defaultExportInterval)
-		data := s.Export()
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
 
-		if s.Exporter == nil {
+// flush 上报当前实例，或者汇总统计下所有实例的数据
+func (s *Stats) flush() {
+	sink := s.getSink()
+	if !s.isAggregate() {
+		s.report(sink)
+		return
+	}
+
+	for _, instance := range s.instances() {
+		// 单独设置了上报的实例由自己上报
+		if instance.getSink() != nil {
 			continue
 		}
+		instance.report(sink)
+	}
+}
 
-		for metric, value := range data {
-			if value == 0 {
-				continue
-			}
-			s.Exporter.Incr("ha-cache", int64(value), statsd.StringTag("m", string(metric)))
-		}
+// report 上报当前实例上次上报之后的增量数据
+func (s *Stats) report(sink metrics.Sink) {
+	data := s.Export()
 
-		for gaugeMetrics, value := range s.ExportGauge() {
-			s.Exporter.Gauge("ha-cache-gauge", int64(value), statsd.StringTag("m", string(gaugeMetrics)))
+	if sink == nil {
+		return
+	}
+
+	name := metrics.T("name", s.Name)
+	for metric, value := range data {
+		if value == 0 {
+			continue
 		}
+		sink.Incr("ha-cache", value, metrics.T("m", string(metric)), name)
+	}
+
+	for gaugeMetrics, value := range s.ExportGauge() {
+		sink.Gauge("ha-cache-gauge", int64(value), metrics.T("m", string(gaugeMetrics)), name)
 	}
 }
 
-// Setup 设置 statsd 连接
-func (s *Stats) Setup(client *statsd.Client) {
-	if s.Exporter != nil || client == nil {
+// Setup 设置指标上报，例如 metrics.NewStatsdSink(statsdClient)
+// 一般只需要设置 CurrentStats，会上报所有缓存实例的数据，也可以通过 Options.MetricsSink 单独设置某个实例
+func (s *Stats) Setup(sink metrics.Sink) {
+	if sink == nil {
 		return
 	}
 
-	s.Exporter = client
+	s.mu.Lock()
+	if s.sink != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.sink = sink
+	s.mu.Unlock()
 
 	go s.Run()
 }
 
-// CurrentStats 全局统计实例
-var CurrentStats = new(Stats)
+// getSink 当前设置的指标上报
+func (s *Stats) getSink() metrics.Sink {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sink
+}
+
+// Stop 停止定时上报，停止前会上报最后一次数据
+// 缓存实例没有单独设置 sink 时，最后一次数据上报到汇总统计的 sink，避免关闭前的数据丢失
+func (s *Stats) Stop() {
+	s.stopOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+		}
+		if s.isAggregate() {
+			if s.getSink() != nil {
+				s.flush()
+			}
+		} else if sink := s.timingSink(); sink != nil {
+			s.report(sink)
+		}
+	})
+}
+
+// CurrentStats 全局汇总统计，所有缓存实例的统计数据都会汇总到这里
+var CurrentStats = newAggregateStats()
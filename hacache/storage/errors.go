@@ -5,4 +5,6 @@ import "errors"
 var (
 	// ErrorCacheMiss 缓存 miss，缓存中不存在该值
 	ErrorCacheMiss = errors.New("cache miss")
+	// ErrorValueTooLarge 写入的值超过 storage 的大小限制
+	ErrorValueTooLarge = errors.New("value too large")
 )
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	// memcachedMaxKeyLength memcached key 的最大长度
+	memcachedMaxKeyLength = 250
+	// memcachedMaxRelativeExpiration memcached 过期时间超过 30 天时按 unix 时间戳处理
+	memcachedMaxRelativeExpiration = 30 * 24 * time.Hour
+	// memcachedHashedKeyPrefix 超长或者包含非法字符的 key 取 hash 之后的前缀
+	memcachedHashedKeyPrefix = "sha1:"
+)
+
+// Memcached memcached storage
+// memcache.Client 不支持 context，请求在单独的 goroutine 中执行，ctx 取消或者超时后直接返回 ctx.Err()，
+// 不再等待的请求仍然受 memcache.Client.Timeout 限制
+type Memcached struct {
+	client *memcache.Client
+}
+
+// NewMemcached return a new memcached storage
+func NewMemcached(client *memcache.Client) *Memcached {
+	return &Memcached{client: client}
+}
+
+// Get memcached get
+func (m *Memcached) Get(ctx context.Context, key string) ([]byte, error) {
+	item, err := memcachedDo(ctx, func() (*memcache.Item, error) {
+		return m.client.Get(memcachedKey(key))
+	})
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrorCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+// MGet memcached 批量 get，返回值与 keys 一一对应，不存在的 key 对应 nil
+func (m *Memcached) MGet(ctx context.Context, keys []string) ([][]byte, error) {
+	mkeys := make([]string, len(keys))
+	for i, key := range keys {
+		mkeys[i] = memcachedKey(key)
+	}
+
+	items, err := memcachedDo(ctx, func() (map[string]*memcache.Item, error) {
+		return m.client.GetMulti(mkeys)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][]byte, len(keys))
+	for i, key := range mkeys {
+		if item, ok := items[key]; ok {
+			result[i] = item.Value
+		}
+	}
+	return result, nil
+}
+
+// Set memcached set
+func (m *Memcached) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	item := &memcache.Item{
+		Key:        memcachedKey(key),
+		Value:      value,
+		Expiration: memcachedExpiration(expiration, time.Now()),
+	}
+	_, err := memcachedDo(ctx, func() (struct{}, error) {
+		return struct{}{}, m.client.Set(item)
+	})
+	return err
+}
+
+// Delete memcached delete，key 不存在时不返回错误
+func (m *Memcached) Delete(ctx context.Context, key string) error {
+	_, err := memcachedDo(ctx, func() (struct{}, error) {
+		return struct{}{}, m.client.Delete(memcachedKey(key))
+	})
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// memcachedDo 执行 memcached 请求，ctx 已经取消时不发出请求
+// ctx 可取消时在单独的 goroutine 中执行，ctx 取消或者到达 deadline 后不再等待，直接返回 ctx.Err()
+func memcachedDo[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	type fnReturn struct {
+		v   T
+		err error
+	}
+	done := make(chan fnReturn, 1)
+	go func() {
+		v, err := fn()
+		done <- fnReturn{v, err}
+	}()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// memcachedKey memcached key 最长 250 字节且不能包含空白与控制字符，不满足时使用 key 的 sha1
+func memcachedKey(key string) string {
+	if len(key) <= memcachedMaxKeyLength && len(key) > 0 {
+		legal := true
+		for i := 0; i < len(key); i++ {
+			if key[i] <= ' ' || key[i] == 0x7f {
+				legal = false
+				break
+			}
+		}
+		if legal {
+			return key
+		}
+	}
+
+	sum := sha1.Sum([]byte(key))
+	return memcachedHashedKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// memcachedExpiration 转换为 memcached 的过期时间
+// memcached 中不超过 30 天的值为相对时间（秒），超过 30 天的值为 unix 时间戳，0 表示不过期
+func memcachedExpiration(expiration time.Duration, now time.Time) int32 {
+	if expiration <= 0 {
+		return 0
+	}
+	if expiration > memcachedMaxRelativeExpiration {
+		return int32(now.Add(expiration).Unix())
+	}
+	// 向上取整，避免不足 1 秒的过期时间变成 0（不过期）
+	return int32((expiration + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// fakeMemcached 进程内的 memcached 文本协议服务，只实现 gets、set、delete
+type fakeMemcached struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	data map[string][]byte
+	// exptime 每个 key 写入时的过期时间参数
+	exptime map[string]int64
+	// delay 每个请求返回前的延迟
+	delay time.Duration
+	// requests 收到的请求数量
+	requests int
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeMemcached{ln: ln, data: make(map[string][]byte), exptime: make(map[string]int64)}
+	go s.serve()
+	t.Cleanup(func() { _ = ln.Close() })
+	return s
+}
+
+func (s *fakeMemcached) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeMemcached) Exptime(key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exptime[key]
+}
+
+func (s *fakeMemcached) SetDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = delay
+}
+
+func (s *fakeMemcached) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *fakeMemcached) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeMemcached) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		s.mu.Lock()
+		s.requests++
+		delay := s.delay
+		s.mu.Unlock()
+		time.Sleep(delay)
+		if err := s.exec(r, w, fields); err != nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeMemcached) exec(r *bufio.Reader, w *bufio.Writer, fields []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch fields[0] {
+	case "get", "gets":
+		for _, key := range fields[1:] {
+			if v, ok := s.data[key]; ok {
+				fmt.Fprintf(w, "VALUE %s 0 %d 1\r\n%s\r\n", key, len(v), v)
+			}
+		}
+		fmt.Fprint(w, "END\r\n")
+	case "set":
+		if len(fields) < 5 {
+			fmt.Fprint(w, "ERROR\r\n")
+			return nil
+		}
+		exptime, _ := strconv.ParseInt(fields[3], 10, 64)
+		size, err := strconv.Atoi(fields[4])
+		if err != nil {
+			fmt.Fprint(w, "CLIENT_ERROR bad data chunk\r\n")
+			return nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		s.data[fields[1]] = buf[:size]
+		s.exptime[fields[1]] = exptime
+		fmt.Fprint(w, "STORED\r\n")
+	case "delete":
+		if _, ok := s.data[fields[1]]; ok {
+			delete(s.data, fields[1])
+			fmt.Fprint(w, "DELETED\r\n")
+		} else {
+			fmt.Fprint(w, "NOT_FOUND\r\n")
+		}
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+	return nil
+}
+
+func TestMemcached(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeMemcached(t)
+	m := NewMemcached(memcache.New(server.Addr()))
+
+	if _, err := m.Get(ctx, "a"); err != ErrorCacheMiss {
+		t.Fatal("expect cache miss, got ", err)
+	}
+	if err := m.Set(ctx, "a", []byte("va"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.Get(ctx, "a"); err != nil || string(v) != "va" {
+		t.Fatal("get error: ", string(v), err)
+	}
+	if exp := server.Exptime("a"); exp != 60 {
+		t.Fatal("expect relative exptime 60, got ", exp)
+	}
+
+	values, err := m.MGet(ctx, []string{"a", "b", "a"})
+	if err != nil || len(values) != 3 || string(values[0]) != "va" || values[1] != nil || string(values[2]) != "va" {
+		t.Fatal("mget error: ", values, err)
+	}
+
+	if err := m.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(ctx, "a"); err != nil {
+		t.Fatal("delete missing key should not fail: ", err)
+	}
+	if _, err := m.Get(ctx, "a"); err != ErrorCacheMiss {
+		t.Fatal("expect cache miss after delete, got ", err)
+	}
+}
+
+func TestMemcached_Key(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeMemcached(t)
+	m := NewMemcached(memcache.New(server.Addr()))
+
+	long := strings.Repeat("k", 300)
+	for _, key := range []string{long, "key with space", "key\nnewline", ""} {
+		if err := m.Set(ctx, key, []byte(key), time.Minute); err != nil {
+			t.Fatalf("set %q: %v", key, err)
+		}
+		if v, err := m.Get(ctx, key); err != nil || string(v) != key {
+			t.Fatalf("get %q: %q %v", key, v, err)
+		}
+	}
+	values, err := m.MGet(ctx, []string{long, "key with space"})
+	if err != nil || string(values[0]) != long || string(values[1]) != "key with space" {
+		t.Fatal("mget error: ", err)
+	}
+
+	if k := memcachedKey("recipe:1"); k != "recipe:1" {
+		t.Fatal("legal key should not change, got ", k)
+	}
+	if k := memcachedKey(long); len(k) > memcachedMaxKeyLength || !strings.HasPrefix(k, memcachedHashedKeyPrefix) {
+		t.Fatal("expect hashed key, got ", k)
+	}
+	if memcachedKey("a b") == memcachedKey("a  b") {
+		t.Fatal("different keys should not collide")
+	}
+}
+
+func TestMemcached_Expiration(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cases := []struct {
+		expiration time.Duration
+		expect     int32
+	}{
+		{0, 0},
+		{-time.Second, 0},
+		{100 * time.Millisecond, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Hour, 3600},
+		{30 * 24 * time.Hour, 30 * 24 * 3600},
+		{31 * 24 * time.Hour, int32(now.Add(31 * 24 * time.Hour).Unix())},
+	}
+	for _, c := range cases {
+		if got := memcachedExpiration(c.expiration, now); got != c.expect {
+			t.Errorf("expiration %v: expect %d, got %d", c.expiration, c.expect, got)
+		}
+	}
+}
+
+func TestMemcached_Context(t *testing.T) {
+	server := newFakeMemcached(t)
+	m := NewMemcached(memcache.New(server.Addr()))
+
+	// ctx 已经取消时不发出请求
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.Get(ctx, "a"); err != context.Canceled {
+		t.Fatal("expect context canceled, got ", err)
+	}
+	if err := m.Set(ctx, "a", []byte("va"), time.Minute); err != context.Canceled {
+		t.Fatal("expect context canceled, got ", err)
+	}
+	if n := server.Requests(); n != 0 {
+		t.Fatal("expect no request sent, got ", n)
+	}
+
+	// 到达 ctx deadline 后直接返回，不等待 memcache.Client.Timeout
+	server.SetDelay(300 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := m.MGet(ctx, []string{"a", "b"}); err != context.DeadlineExceeded {
+		t.Fatal("expect deadline exceeded, got ", err)
+	}
+	if cost := time.Since(start); cost > 200*time.Millisecond {
+		t.Fatal("expect return at ctx deadline, cost ", cost)
+	}
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMemoryShards        = 16
+	defaultMemorySweepInterval = time.Minute
+)
+
+// MemoryOptions 内存 storage 配置
+type MemoryOptions struct {
+	// 分片数量，每个分片单独加锁，默认 16，设置了 MaxEntries 时不超过 MaxEntries
+	Shards int
+	// 最多保存的 key 数量，0 表示不限制，超过后按 LRU 淘汰
+	// 限制分配到每个分片，所有分片的限制之和等于 MaxEntries，淘汰只在分片内进行
+	MaxEntries int
+	// 最多占用的字节数（key + value），0 表示不限制，超过后按 LRU 淘汰
+	// 限制平均分配到每个分片，单个 key + value 超过 MaxBytes/Shards（向上取整）时 Set 返回 ErrorValueTooLarge
+	MaxBytes int64
+	// 后台清理过期 key 的间隔，默认 1 分钟，小于 0 时不清理，过期的 key 只在读取时删除
+	SweepInterval time.Duration
+}
+
+// memoryEntry 内存中保存的值
+type memoryEntry struct {
+	key   string
+	value []byte
+	// expireAt 过期时间，零值表示不过期
+	expireAt time.Time
+}
+
+// size 占用的字节数
+func (e *memoryEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+// expired 在 now 时刻是否已经过期
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && now.After(e.expireAt)
+}
+
+// memoryShard 一个分片，LRU 淘汰
+type memoryShard struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+}
+
+// Memory 进程内存 storage，支持过期时间、按 key 数量和字节数限制大小，超过限制时按 LRU 淘汰
+// 不再使用时需要调用 Close 停止后台清理
+type Memory struct {
+	shards    []*memoryShard
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemory return a new memory storage
+func NewMemory(opt *MemoryOptions) *Memory {
+	if opt == nil {
+		opt = &MemoryOptions{}
+	}
+	n := opt.Shards
+	if n <= 0 {
+		n = defaultMemoryShards
+	}
+	// 每个分片至少保存一个 key，分片数量不超过 MaxEntries
+	if opt.MaxEntries > 0 && n > opt.MaxEntries {
+		n = opt.MaxEntries
+	}
+
+	m := &Memory{
+		shards: make([]*memoryShard, n),
+		stop:   make(chan struct{}),
+	}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{
+			entries:    make(map[string]*list.Element),
+			lru:        list.New(),
+			maxEntries: splitShard(opt.MaxEntries, n, i),
+			maxBytes:   int64(perShard(opt.MaxBytes, n)),
+		}
+	}
+
+	interval := opt.SweepInterval
+	if interval == 0 {
+		interval = defaultMemorySweepInterval
+	}
+	if interval > 0 {
+		go m.sweep(interval)
+	}
+	return m
+}
+
+// perShard 每个分片的限制，向上取整
+func perShard(limit int64, n int) int {
+	if limit <= 0 {
+		return 0
+	}
+	return int((limit + int64(n) - 1) / int64(n))
+}
+
+// splitShard 第 i 个分片的限制，limit 平均分配到 n 个分片，余数分配给前面的分片，所有分片的限制之和等于 limit
+func splitShard(limit, n, i int) int {
+	if limit <= 0 {
+		return 0
+	}
+	if i < limit%n {
+		return limit/n + 1
+	}
+	return limit / n
+}
+
+// shard key 所在的分片
+func (m *Memory) shard(key string) *memoryShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
+
+// Get 读取 key，不存在或者已经过期时返回 ErrorCacheMiss
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, ErrorCacheMiss
+	}
+	entry := elem.Value.(*memoryEntry)
+	if entry.expired(time.Now()) {
+		s.remove(elem)
+		return nil, ErrorCacheMiss
+	}
+	s.lru.MoveToFront(elem)
+	return append([]byte(nil), entry.value...), nil
+}
+
+// MGet 批量读取，返回值与 keys 一一对应，不存在的 key 对应 nil
+func (m *Memory) MGet(ctx context.Context, keys []string) ([][]byte, error) {
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		if v, err := m.Get(ctx, key); err == nil {
+			result[i] = v
+		}
+	}
+	return result, nil
+}
+
+// Set 写入 key，expiration <= 0 时不过期，超过分片字节数限制的值返回 ErrorValueTooLarge
+func (m *Memory) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	entry := &memoryEntry{key: key, value: append([]byte(nil), value...)}
+	if expiration > 0 {
+		entry.expireAt = time.Now().Add(expiration)
+	}
+
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	// 单个值超过分片的字节数限制，不保存，已有的旧值也已经删除
+	if s.maxBytes > 0 && entry.size() > s.maxBytes {
+		return ErrorValueTooLarge
+	}
+
+	s.entries[key] = s.lru.PushFront(entry)
+	s.bytes += entry.size()
+	for (s.maxEntries > 0 && s.lru.Len() > s.maxEntries) || (s.maxBytes > 0 && s.bytes > s.maxBytes) {
+		s.remove(s.lru.Back())
+	}
+	return nil
+}
+
+// Delete 删除 key，key 不存在时不返回错误
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	return nil
+}
+
+// Len 当前保存的 key 数量，包括已经过期但还没有被清理的 key
+func (m *Memory) Len() int {
+	n := 0
+	for _, s := range m.shards {
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Bytes 当前占用的字节数
+func (m *Memory) Bytes() int64 {
+	var n int64
+	for _, s := range m.shards {
+		s.mu.Lock()
+		n += s.bytes
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Close 停止后台清理
+func (m *Memory) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+	})
+	return nil
+}
+
+// sweep 定时清理过期的 key
+func (m *Memory) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.removeExpired()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// removeExpired 清理所有分片中过期的 key
+func (m *Memory) removeExpired() {
+	now := time.Now()
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for _, elem := range s.entries {
+			if elem.Value.(*memoryEntry).expired(now) {
+				s.remove(elem)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// remove 删除 elem，需要持有锁
+func (s *memoryShard) remove(elem *list.Element) {
+	entry := elem.Value.(*memoryEntry)
+	s.lru.Remove(elem)
+	delete(s.entries, entry.key)
+	s.bytes -= entry.size()
+}
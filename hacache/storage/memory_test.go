@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(nil)
+	defer m.Close()
+
+	if _, err := m.Get(ctx, "a"); err != ErrorCacheMiss {
+		t.Fatal("expect cache miss, got ", err)
+	}
+
+	value := []byte("hello")
+	if err := m.Set(ctx, "a", value, 0); err != nil {
+		t.Fatal(err)
+	}
+	// 修改传入的值不影响已保存的值
+	value[0] = 'H'
+	v, err := m.Get(ctx, "a")
+	if err != nil || string(v) != "hello" {
+		t.Fatal("get error: ", string(v), err)
+	}
+
+	values, err := m.MGet(ctx, []string{"a", "b"})
+	if err != nil || len(values) != 2 || string(values[0]) != "hello" || values[1] != nil {
+		t.Fatal("mget error: ", values, err)
+	}
+
+	if err := m.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(ctx, "a"); err != nil {
+		t.Fatal("delete missing key should not fail: ", err)
+	}
+	if _, err := m.Get(ctx, "a"); err != ErrorCacheMiss {
+		t.Fatal("expect cache miss after delete, got ", err)
+	}
+	if m.Len() != 0 || m.Bytes() != 0 {
+		t.Fatal("expect empty storage, got ", m.Len(), m.Bytes())
+	}
+}
+
+func TestMemory_Expiration(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(&MemoryOptions{SweepInterval: -1})
+	defer m.Close()
+
+	_ = m.Set(ctx, "a", []byte("a"), 50*time.Millisecond)
+	_ = m.Set(ctx, "b", []byte("b"), 0)
+	if _, err := m.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := m.Get(ctx, "a"); err != ErrorCacheMiss {
+		t.Fatal("expect expired key to miss, got ", err)
+	}
+	if _, err := m.Get(ctx, "b"); err != nil {
+		t.Fatal("key without expiration should not expire: ", err)
+	}
+	if m.Len() != 1 {
+		t.Fatal("expired key should be removed on get, len: ", m.Len())
+	}
+}
+
+func TestMemory_Sweep(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(&MemoryOptions{SweepInterval: 20 * time.Millisecond})
+	defer m.Close()
+
+	for i := 0; i < 10; i++ {
+		_ = m.Set(ctx, fmt.Sprint(i), []byte("v"), 10*time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if m.Len() != 0 || m.Bytes() != 0 {
+		t.Fatal("expired keys should be swept, len: ", m.Len(), " bytes: ", m.Bytes())
+	}
+}
+
+func TestMemory_MaxEntries(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(&MemoryOptions{Shards: 1, MaxEntries: 2})
+	defer m.Close()
+
+	_ = m.Set(ctx, "a", []byte("a"), 0)
+	_ = m.Set(ctx, "b", []byte("b"), 0)
+	// 访问 a 之后 b 是最久没有访问的 key
+	_, _ = m.Get(ctx, "a")
+	_ = m.Set(ctx, "c", []byte("c"), 0)
+
+	if _, err := m.Get(ctx, "b"); err != ErrorCacheMiss {
+		t.Fatal("expect b to be evicted, got ", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, err := m.Get(ctx, key); err != nil {
+			t.Fatal("expect ", key, " to be kept: ", err)
+		}
+	}
+	if m.Len() != 2 {
+		t.Fatal("expect 2 entries, got ", m.Len())
+	}
+}
+
+func TestMemory_MaxEntriesShards(t *testing.T) {
+	ctx := context.Background()
+	for _, maxEntries := range []int{4, 20} {
+		m := NewMemory(&MemoryOptions{MaxEntries: maxEntries})
+		for i := 0; i < 1000; i++ {
+			_ = m.Set(ctx, fmt.Sprint(i), []byte("v"), 0)
+		}
+		// 所有分片的限制之和等于 MaxEntries，写满之后正好保存 MaxEntries 个 key
+		if m.Len() != maxEntries {
+			t.Fatal("expect ", maxEntries, " entries, got ", m.Len())
+		}
+		m.Close()
+	}
+}
+
+func TestMemory_MaxBytes(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(&MemoryOptions{Shards: 1, MaxBytes: 20})
+	defer m.Close()
+
+	_ = m.Set(ctx, "a", make([]byte, 9), 0)
+	_ = m.Set(ctx, "b", make([]byte, 9), 0)
+	if m.Bytes() != 20 {
+		t.Fatal("expect 20 bytes, got ", m.Bytes())
+	}
+
+	_ = m.Set(ctx, "c", make([]byte, 9), 0)
+	if _, err := m.Get(ctx, "a"); err != ErrorCacheMiss {
+		t.Fatal("expect a to be evicted, got ", err)
+	}
+	if m.Bytes() != 20 {
+		t.Fatal("expect 20 bytes, got ", m.Bytes())
+	}
+
+	// 覆盖写入时按新的大小计算
+	_ = m.Set(ctx, "c", make([]byte, 4), 0)
+	if m.Bytes() != 15 {
+		t.Fatal("expect 15 bytes, got ", m.Bytes())
+	}
+
+	// 超过限制的值不保存，返回错误
+	if err := m.Set(ctx, "d", make([]byte, 100), 0); err != ErrorValueTooLarge {
+		t.Fatal("expect ErrorValueTooLarge, got ", err)
+	}
+	if _, err := m.Get(ctx, "d"); err != ErrorCacheMiss {
+		t.Fatal("expect oversized value to be dropped, got ", err)
+	}
+	if m.Len() != 2 {
+		t.Fatal("expect 2 entries, got ", m.Len())
+	}
+
+	// 字节数限制按分片平均分配，超过单个分片限制的值同样返回错误
+	sharded := NewMemory(&MemoryOptions{Shards: 4, MaxBytes: 40})
+	defer sharded.Close()
+	if err := sharded.Set(ctx, "a", make([]byte, 9), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := sharded.Set(ctx, "b", make([]byte, 10), 0); err != ErrorValueTooLarge {
+		t.Fatal("expect ErrorValueTooLarge, got ", err)
+	}
+}
+
+func TestMemory_Concurrency(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(&MemoryOptions{MaxEntries: 100, SweepInterval: time.Millisecond})
+	defer m.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := fmt.Sprint(i*1000 + j)
+				_ = m.Set(ctx, key, []byte(key), time.Millisecond)
+				_, _ = m.Get(ctx, key)
+				if j%10 == 0 {
+					_ = m.Delete(ctx, key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if m.Len() > 100 {
+		t.Fatal("too many entries: ", m.Len())
+	}
+}
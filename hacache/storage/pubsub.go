@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// pubsubHealthCheckInterval 一段时间没有收到消息时 ping，及时发现断开的连接
+	pubsubHealthCheckInterval = 30 * time.Second
+	// pubsubRetryInterval 连接出错后重试的间隔
+	pubsubRetryInterval = time.Second
+)
+
+// Publish 向 channel 广播消息，redis PUBLISH
+func (r *Redis) Publish(ctx context.Context, channel, message string) error {
+	if r.client == nil {
+		return ErrNilRedis
+	}
+
+	return r.client.Publish(ctx, channel, message).Err()
+}
+
+// Subscribe 订阅 channel，在后台 goroutine 中接收消息，收到消息时调用 onMessage
+// 连接断开后自动重新连接并重新订阅，每次（重新）订阅成功时调用 onSubscribe，
+// 断开期间广播的消息会丢失，调用方可以在 onSubscribe 中清理本地状态
+// 返回的函数取消订阅，并等待后台 goroutine 退出
+func (r *Redis) Subscribe(channel string, onMessage func(message string), onSubscribe func()) (func() error, error) {
+	if r.client == nil {
+		return nil, ErrNilRedis
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pubsub := r.client.Subscribe(ctx, channel)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		receive(ctx, pubsub, onMessage, onSubscribe)
+	}()
+
+	return func() error {
+		cancel()
+		err := pubsub.Close()
+		<-done
+		return err
+	}, nil
+}
+
+// receive 接收订阅的消息，直到 ctx 取消
+func receive(ctx context.Context, pubsub *redis.PubSub, onMessage func(message string), onSubscribe func()) {
+	for {
+		msg, err := pubsub.ReceiveTimeout(ctx, pubsubHealthCheckInterval)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// 超时时 ping 检查连接，连接断开时 go-redis 在下次读取时重新连接并重新订阅
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				_ = pubsub.Ping(ctx)
+				continue
+			}
+			select {
+			case <-time.After(pubsubRetryInterval):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind == "subscribe" && onSubscribe != nil {
+				onSubscribe()
+			}
+		case *redis.Message:
+			onMessage(m.Payload)
+		}
+	}
+}
@@ -3,15 +3,15 @@ package storage
 import (
 	"context"
 	"errors"
-	"strings"
+	"reflect"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
-// Redis redis storage
+// Redis redis storage，支持单节点、sentinel（failover）、cluster 与 ring 客户端
 type Redis struct {
-	client *redis.Client
+	client redis.UniversalClient
 }
 
 var (
@@ -19,35 +19,129 @@ var (
 	ErrNilRedis = errors.New("redis not found")
 )
 
+// releaseScript 只在 key 的值为 token 时删除 key，避免删除其他实例在租约过期后重新获取的租约
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
 // Get redis GET
-func (r *Redis) Get(key string) ([]byte, error) {
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	if r.client == nil {
+		return nil, ErrNilRedis
+	}
+
+	v, err := r.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrorCacheMiss
+	}
+	return v, err
+}
+
+// MGet 批量读取，返回值与 keys 一一对应，不存在的 key 对应 nil
+// 单节点客户端使用 MGET；cluster、ring 中的 key 可能分布在不同节点上，MGET 会返回 CROSSSLOT 错误，
+// 因此使用 pipeline 执行 GET，由客户端按节点拆分请求
+func (r *Redis) MGet(ctx context.Context, keys []string) ([][]byte, error) {
 	if r.client == nil {
 		return nil, ErrNilRedis
 	}
+	if len(keys) == 0 {
+		return [][]byte{}, nil
+	}
 
-	v := r.client.Get(context.Background(), key)
-	if v.Err() != nil {
-		if strings.Contains(v.Err().Error(), "redis: nil") {
-			return nil, ErrorCacheMiss
+	if _, ok := r.client.(*redis.Client); ok {
+		return r.mget(ctx, keys)
+	}
+	return r.pipelineGet(ctx, keys)
+}
+
+// mget redis MGET
+func (r *Redis) mget(ctx context.Context, keys []string) ([][]byte, error) {
+	vals, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][]byte, len(vals))
+	for i, v := range vals {
+		if s, ok := v.(string); ok {
+			result[i] = []byte(s)
 		}
+	}
+	return result, nil
+}
 
-		return nil, v.Err()
+// pipelineGet 通过 pipeline 执行 GET
+func (r *Redis) pipelineGet(ctx context.Context, keys []string) ([][]byte, error) {
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(ctx, key)
+	}
+	// 不存在的 key 返回 redis.Nil，逐个检查命令的结果
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
 	}
 
-	return v.Bytes()
+	result := make([][]byte, len(keys))
+	for i, cmd := range cmds {
+		v, err := cmd.Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[i] = v
+	}
+	return result, nil
 }
 
 // Set redis SET
-func (r *Redis) Set(key string, value []byte, expiration time.Duration) error {
+func (r *Redis) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
 	if r.client == nil {
 		return ErrNilRedis
 	}
 
-	v := r.client.Set(context.Background(), key, value, expiration)
+	v := r.client.Set(ctx, key, value, expiration)
 	return v.Err()
 }
 
+// Delete redis DEL
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	if r.client == nil {
+		return ErrNilRedis
+	}
+
+	return r.client.Del(ctx, key).Err()
+}
+
+// Acquire 获取租约，redis SET key token NX PX ttl
+func (r *Redis) Acquire(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	if r.client == nil {
+		return false, ErrNilRedis
+	}
+
+	return r.client.SetNX(ctx, key, token, ttl).Result()
+}
+
+// Release 释放租约，key 的值为 token 时删除 key
+func (r *Redis) Release(ctx context.Context, key, token string) error {
+	if r.client == nil {
+		return ErrNilRedis
+	}
+
+	return releaseScript.Run(ctx, r.client, []string{key}, token).Err()
+}
+
 // NewRedis return a new redis storage
-func NewRedis(client *redis.Client) *Redis {
+// client 可以是 *redis.Client、redis.NewFailoverClient、*redis.ClusterClient 或者 redis.NewUniversalClient 创建的客户端
+// 传入 nil 指针（例如未初始化的 *redis.Client）时与 nil 一样，调用时返回 ErrNilRedis
+func NewRedis(client redis.UniversalClient) *Redis {
+	if v := reflect.ValueOf(client); v.Kind() == reflect.Ptr && v.IsNil() {
+		client = nil
+	}
 	return &Redis{client: client}
 }
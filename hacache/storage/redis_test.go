@@ -0,0 +1,452 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// fakeRedis 进程内的 redis 服务，只实现测试用到的命令
+type fakeRedis struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	data map[string]string
+	// cmds 执行过的命令名称
+	cmds []string
+	// conns 当前所有的连接
+	conns map[*fakeConn]struct{}
+	// subscribers 订阅了 channel 的连接
+	subscribers map[string]map[*fakeConn]struct{}
+}
+
+// fakeConn 客户端连接，PUBLISH 时会从其他连接的 goroutine 写入
+type fakeConn struct {
+	conn       net.Conn
+	mu         sync.Mutex
+	w          *bufio.Writer
+	subscribed bool
+}
+
+func (c *fakeConn) write(b []byte, flush bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.w.Write(b); err != nil {
+		return err
+	}
+	if flush {
+		return c.w.Flush()
+	}
+	return nil
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		ln:          ln,
+		data:        make(map[string]string),
+		conns:       make(map[*fakeConn]struct{}),
+		subscribers: make(map[string]map[*fakeConn]struct{}),
+	}
+	go s.serve()
+	t.Cleanup(func() {
+		_ = ln.Close()
+		s.DropConnections()
+	})
+	return s
+}
+
+func (s *fakeRedis) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Commands 执行过的命令名称
+func (s *fakeRedis) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.cmds...)
+}
+
+// DropConnections 断开所有连接，模拟网络故障
+func (s *fakeRedis) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		_ = c.conn.Close()
+	}
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedis) handle(conn net.Conn) {
+	c := &fakeConn{conn: conn, w: bufio.NewWriter(conn)}
+	s.mu.Lock()
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		for _, subs := range s.subscribers {
+			delete(subs, c)
+		}
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		var out bytes.Buffer
+		s.exec(c, &out, args)
+		if err := c.write(out.Bytes(), r.Buffered() == 0); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedis) exec(c *fakeConn, w io.Writer, args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := strings.ToLower(args[0])
+	s.cmds = append(s.cmds, name)
+	switch name {
+	case "ping":
+		if c.subscribed {
+			fmt.Fprint(w, "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+		} else {
+			fmt.Fprint(w, "+PONG\r\n")
+		}
+	case "subscribe":
+		c.subscribed = true
+		for i, channel := range args[1:] {
+			if s.subscribers[channel] == nil {
+				s.subscribers[channel] = make(map[*fakeConn]struct{})
+			}
+			s.subscribers[channel][c] = struct{}{}
+			fmt.Fprint(w, "*3\r\n")
+			writeBulk(w, "subscribe")
+			writeBulk(w, channel)
+			fmt.Fprintf(w, ":%d\r\n", i+1)
+		}
+	case "publish":
+		var msg bytes.Buffer
+		fmt.Fprint(&msg, "*3\r\n")
+		writeBulk(&msg, "message")
+		writeBulk(&msg, args[1])
+		writeBulk(&msg, args[2])
+		for sub := range s.subscribers[args[1]] {
+			_ = sub.write(msg.Bytes(), true)
+		}
+		fmt.Fprintf(w, ":%d\r\n", len(s.subscribers[args[1]]))
+	case "command":
+		// ring、cluster 客户端根据 COMMAND 的返回确定 key 的位置
+		infos := [][]interface{}{
+			{"get", 2, 1, 1, 1},
+			{"set", -3, 1, 1, 1},
+			{"mget", -2, 1, -1, 1},
+			{"del", -2, 1, -1, 1},
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(infos))
+		for _, info := range infos {
+			fmt.Fprint(w, "*6\r\n")
+			writeBulk(w, info[0].(string))
+			fmt.Fprintf(w, ":%d\r\n*0\r\n:%d\r\n:%d\r\n:%d\r\n", info[1:]...)
+		}
+	case "get":
+		if v, ok := s.data[args[1]]; ok {
+			writeBulk(w, v)
+		} else {
+			fmt.Fprint(w, "$-1\r\n")
+		}
+	case "mget":
+		fmt.Fprintf(w, "*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			if v, ok := s.data[key]; ok {
+				writeBulk(w, v)
+			} else {
+				fmt.Fprint(w, "$-1\r\n")
+			}
+		}
+	case "set":
+		key, value := args[1], args[2]
+		for _, opt := range args[3:] {
+			if strings.EqualFold(opt, "nx") {
+				if _, ok := s.data[key]; ok {
+					fmt.Fprint(w, "$-1\r\n")
+					return
+				}
+			}
+		}
+		s.data[key] = value
+		fmt.Fprint(w, "+OK\r\n")
+	case "del":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.data[key]; ok {
+				delete(s.data, key)
+				n++
+			}
+		}
+		fmt.Fprintf(w, ":%d\r\n", n)
+	case "evalsha":
+		fmt.Fprint(w, "-NOSCRIPT No matching script. Please use EVAL.\r\n")
+	case "eval":
+		// 只支持 releaseScript：KEYS[1] 的值为 ARGV[1] 时删除
+		key, token := args[3], args[4]
+		if v, ok := s.data[key]; ok && v == token {
+			delete(s.data, key)
+			fmt.Fprint(w, ":1\r\n")
+		} else {
+			fmt.Fprint(w, ":0\r\n")
+		}
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeBulk(w io.Writer, v string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+}
+
+func TestRedis(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeRedis(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	r := NewRedis(client)
+
+	if _, err := r.Get(ctx, "a"); err != ErrorCacheMiss {
+		t.Fatal("expect cache miss, got ", err)
+	}
+	if err := r.Set(ctx, "a", []byte("va"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := r.Get(ctx, "a"); err != nil || string(v) != "va" {
+		t.Fatal("get error: ", string(v), err)
+	}
+
+	values, err := r.MGet(ctx, []string{"a", "b"})
+	if err != nil || len(values) != 2 || string(values[0]) != "va" || values[1] != nil {
+		t.Fatal("mget error: ", values, err)
+	}
+	// 单节点客户端使用 MGET
+	if cmds := server.Commands(); cmds[len(cmds)-1] != "mget" {
+		t.Fatal("expect mget, got ", cmds)
+	}
+
+	if err := r.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Get(ctx, "a"); err != ErrorCacheMiss {
+		t.Fatal("expect cache miss after delete, got ", err)
+	}
+}
+
+func TestRedis_Ring(t *testing.T) {
+	ctx := context.Background()
+	s1, s2 := newFakeRedis(t), newFakeRedis(t)
+	ring := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{"s1": s1.Addr(), "s2": s2.Addr()},
+	})
+	defer ring.Close()
+	r := NewRedis(ring)
+
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprint("key-", i)
+		if i%2 == 0 {
+			if err := r.Set(ctx, keys[i], []byte(keys[i]), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s1.mu.Lock()
+	n1 := len(s1.data)
+	s1.mu.Unlock()
+	if n1 == 0 || n1 == 10 {
+		t.Fatal("expect keys spread over shards, s1 has ", n1)
+	}
+
+	// key 分布在不同的节点上，MGet 需要按节点拆分
+	values, err := r.MGet(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range values {
+		if i%2 == 0 && string(v) != keys[i] {
+			t.Fatal("expect ", keys[i], ", got ", string(v))
+		}
+		if i%2 == 1 && v != nil {
+			t.Fatal("expect nil for missing key ", keys[i], ", got ", string(v))
+		}
+	}
+}
+
+func TestRedis_NilClient(t *testing.T) {
+	r := NewRedis(nil)
+	if _, err := r.Get(context.Background(), "a"); err != ErrNilRedis {
+		t.Fatal("expect ErrNilRedis, got ", err)
+	}
+
+	// nil 指针与 nil 一样处理，不会 panic
+	var client *redis.Client
+	r = NewRedis(client)
+	if _, err := r.Get(context.Background(), "a"); err != ErrNilRedis {
+		t.Fatal("expect ErrNilRedis for nil *redis.Client, got ", err)
+	}
+	if _, err := r.MGet(context.Background(), []string{"a"}); err != ErrNilRedis {
+		t.Fatal("expect ErrNilRedis for nil *redis.Client, got ", err)
+	}
+}
+
+func TestRedis_Lease(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeRedis(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	r := NewRedis(client)
+
+	if ok, err := r.Acquire(ctx, "lease", "t1", time.Second); err != nil || !ok {
+		t.Fatal("expect lease acquired: ", ok, err)
+	}
+	if ok, err := r.Acquire(ctx, "lease", "t2", time.Second); err != nil || ok {
+		t.Fatal("expect lease held by t1: ", ok, err)
+	}
+
+	// 其他 token 不能释放租约
+	if err := r.Release(ctx, "lease", "t2"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := r.Acquire(ctx, "lease", "t2", time.Second); ok {
+		t.Fatal("lease should not be released by other token")
+	}
+
+	if err := r.Release(ctx, "lease", "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.Acquire(ctx, "lease", "t2", time.Second); err != nil || !ok {
+		t.Fatal("expect lease acquired after release: ", ok, err)
+	}
+}
+
+func TestRedis_PubSub(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeRedis(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	r := NewRedis(client)
+
+	messages := make(chan string, 10)
+	subscribed := make(chan struct{}, 10)
+	cancel, err := r.Subscribe("invalidation", func(message string) {
+		messages <- message
+	}, func() {
+		subscribed <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(name string) {
+		select {
+		case <-subscribed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("subscribe timeout: ", name)
+		}
+	}
+	expect := func(message string) {
+		select {
+		case m := <-messages:
+			if m != message {
+				t.Fatal("expect ", message, ", got ", m)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("receive timeout: ", message)
+		}
+	}
+
+	wait("subscribe")
+	if err := r.Publish(ctx, "invalidation", "k1"); err != nil {
+		t.Fatal(err)
+	}
+	expect("k1")
+
+	// 断开连接后重新订阅，并再次调用 onSubscribe
+	server.DropConnections()
+	wait("resubscribe")
+	publishClient := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer publishClient.Close()
+	publisher := NewRedis(publishClient)
+	if err := publisher.Publish(ctx, "invalidation", "k2"); err != nil {
+		t.Fatal(err)
+	}
+	expect("k2")
+
+	if err := cancel(); err != nil {
+		t.Fatal(err)
+	}
+}
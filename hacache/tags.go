@@ -0,0 +1,97 @@
+package hacache
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// tagKeyPrefix tag 版本在 storage 中的 key 前缀，tag 在所有 HaCache 实例间共享
+const tagKeyPrefix = "__hacache_tag__:"
+
+// invalidTagVersion 原函数执行期间 tag 被失效时记录的版本，不会与 storage 中的版本相等
+const invalidTagVersion int64 = -1
+
+// tagKey tag 版本在 storage 中的 key
+func tagKey(tag string) string {
+	return tagKeyPrefix + tag
+}
+
+// InvalidateTag 使所有关联了 tag 的缓存失效
+// 失效通过更新 tag 的版本实现，读取缓存时发现 tag 版本变化，按超过最大可接受过期时间的缓存处理
+func (hc *HaCache) InvalidateTag(ctx context.Context, tag string) error {
+	version := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return hc.opt.Storage.Set(ctx, tagKey(tag), []byte(version), hc.opt.TagExpiration)
+}
+
+// tagVersions 读取 tags 的当前版本，从未失效过的 tag 版本为 0
+func (hc *HaCache) tagVersions(ctx context.Context, tags []string) (map[string]int64, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = tagKey(tag)
+	}
+	bs, err := hc.mget(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]int64, len(tags))
+	for i, tag := range tags {
+		versions[tag] = parseTagVersion(bs[i])
+	}
+	return versions, nil
+}
+
+// parseTagVersion 解析 storage 中的 tag 版本
+func parseTagVersion(b []byte) int64 {
+	if b == nil {
+		return 0
+	}
+	v, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// checkTags 检查缓存值关联的 tag 是否失效，返回值与 values 一一对应
+// 所有 tag 通过一次 storage 请求读取，没有关联 tag 的缓存值（包括 nil）都是有效的，
+// 读取 tag 版本出错时，所有关联了 tag 的缓存值都视为失效
+func (hc *HaCache) checkTags(ctx context.Context, values []*CachedValue) []bool {
+	valid := make([]bool, len(values))
+	var tags []string
+	seen := make(map[string]bool)
+	for i, v := range values {
+		valid[i] = true
+		if v == nil {
+			continue
+		}
+		for tag := range v.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return valid
+	}
+
+	versions, err := hc.tagVersions(ctx, tags)
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		for tag, version := range v.Tags {
+			if err != nil || versions[tag] != version {
+				valid[i] = false
+				break
+			}
+		}
+	}
+	return valid
+}
@@ -0,0 +1,73 @@
+package hacache
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"google.golang.org/grpc/codes"
+)
+
+// tracerName 默认 tracer 的名称
+const tracerName = "github.com/xiachufang/pkg/v2/hacache"
+
+// span 名称
+const (
+	spanDo            = "hacache.Do"
+	spanDoMulti       = "hacache.DoMulti"
+	spanStorageGet    = "hacache.Storage.Get"
+	spanStorageMGet   = "hacache.Storage.MGet"
+	spanStorageSet    = "hacache.Storage.Set"
+	spanDecode        = "hacache.Encoder.Decode"
+	spanFnRun         = "hacache.FnRun"
+	spanBatchFnRun    = "hacache.BatchFn"
+	spanRefresh       = "hacache.Refresh"
+	outcomeLimited    = "limited"
+	attrKeyName       = "hacache.name"
+	attrKeyKey        = "hacache.key"
+	attrKeyOutcome    = "hacache.outcome"
+	attrKeyCount      = "hacache.count"
+	attrKeyBackground = "hacache.background"
+)
+
+// startSpan 从 ctx 创建 span，所有 span 都带上缓存名称
+func (hc *HaCache) startSpan(ctx context.Context, name string, attrs ...kv.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, kv.String(attrKeyName, hc.stats.Name))
+	return hc.opt.Tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan 记录错误并结束 span
+func endSpan(ctx context.Context, span trace.Span, err error) {
+	recordError(ctx, span, err)
+	span.End()
+}
+
+// recordError err 不为空时在 span 上记录错误，ErrorNotFound 不算错误
+func recordError(ctx context.Context, span trace.Span, err error) {
+	if err != nil && err != ErrorNotFound {
+		span.RecordError(ctx, err, trace.WithErrorStatus(codes.Unknown))
+	}
+}
+
+// outcome 记录 Do 的结果统计，同时设置到 span 上
+func (hc *HaCache) outcome(span trace.Span, m MetricType) {
+	hc.stats.Incr(m, 1)
+	span.SetAttributes(kv.String(attrKeyOutcome, string(m)))
+}
+
+// spanContext ctx 中的 span，触发后台更新时传给 event，后台更新的 span 链接到该 span
+func spanContext(ctx context.Context) trace.SpanContext {
+	return trace.SpanFromContext(ctx).SpanContext()
+}
+
+// startRefreshSpan 创建后台更新的 span，后台更新不属于触发请求的 trace，通过 link 关联
+func (hc *HaCache) startRefreshSpan(ctx context.Context, key string, link trace.SpanContext) (context.Context, trace.Span) {
+	opts := []trace.StartOption{
+		trace.WithNewRoot(),
+		trace.WithAttributes(kv.String(attrKeyName, hc.stats.Name), kv.String(attrKeyKey, key)),
+	}
+	if link.IsValid() {
+		opts = append(opts, trace.LinkedTo(link))
+	}
+	return hc.opt.Tracer.Start(ctx, spanRefresh, opts...)
+}
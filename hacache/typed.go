@@ -0,0 +1,229 @@
+package hacache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// LoadFn 泛型缓存的原函数
+type LoadFn[A, V any] func(ctx context.Context, arg A) (V, error)
+
+// KeyFn 泛型缓存生成缓存 key 的函数，参数与 LoadFn 一致
+type KeyFn[A any] func(arg A) string
+
+// BatchLoadFn 泛型缓存批量执行的原函数，返回缓存 key 到结果的映射
+// 返回 error 时，本次批量执行的所有参数都视为执行出错
+type BatchLoadFn[A, V any] func(ctx context.Context, args []A) (map[string]V, error)
+
+// TypedOptions 泛型 ha-cache 配置
+// 内嵌的 Options.Fn、Options.GenKeyFn 会被忽略，使用这里的泛型函数
+type TypedOptions[A, V any] struct {
+	Options
+
+	// 被缓存的原函数
+	Fn LoadFn[A, V]
+
+	// 生成缓存 key 的函数
+	GenKeyFn KeyFn[A]
+
+	// 批量执行的原函数，返回缓存 key 到结果的映射，DoMulti 时使用
+	BatchFn BatchLoadFn[A, V]
+
+	// 返回缓存关联的 tag，InvalidateTag 后关联该 tag 的缓存都会失效
+	TagsFn func(arg A, val V) []string
+}
+
+// Typed 类型安全的 ha-cache
+// 函数签名在编译期检查，不再通过反射调用原函数，Do 直接返回 V
+type Typed[A, V any] struct {
+	hc *HaCache
+}
+
+// NewTyped return a new typed ha-cache instance
+func NewTyped[A, V any](opt *TypedOptions[A, V]) (*Typed[A, V], error) {
+	if opt.Storage == nil {
+		return nil, errors.New("no storage found")
+	}
+	if opt.Fn == nil {
+		return nil, errors.New("no fn found")
+	}
+	if opt.GenKeyFn == nil {
+		return nil, errors.New("no gen key fn found")
+	}
+	if opt.Encoder == nil {
+		opt.Encoder = &TypedEncoder[V]{}
+	}
+	opt.Init()
+
+	fn := func(ctx context.Context, args []interface{}) (*FnResult, error) {
+		arg := typedArg[A](args)
+		v, err := opt.Fn(ctx, arg)
+		return typedResult(opt, arg, v, err), nil
+	}
+	genKey := func(ctx context.Context, args []interface{}) string {
+		return opt.GenKeyFn(typedArg[A](args))
+	}
+	if opt.BatchFn != nil {
+		opt.Options.BatchFn = func(ctx context.Context, argsList [][]interface{}) map[string]*FnResult {
+			args := make([]A, len(argsList))
+			for i := range argsList {
+				args[i] = typedArg[A](argsList[i])
+			}
+
+			vals, err := opt.BatchFn(ctx, args)
+			results := make(map[string]*FnResult, len(args))
+			for _, arg := range args {
+				key := opt.GenKeyFn(arg)
+				if v, ok := vals[key]; ok || err != nil {
+					results[key] = typedResult(opt, arg, v, err)
+				}
+			}
+			return results
+		}
+	}
+
+	hc, err := newHaCache(&opt.Options, fn, genKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Typed[A, V]{hc: hc}, nil
+}
+
+// typedResult 将泛型原函数的返回值转换为 FnResult
+func typedResult[A, V any](opt *TypedOptions[A, V], arg A, v V, err error) *FnResult {
+	// 原函数返回 ErrorNotFound 表示结果不存在，开启负缓存时写入缓存
+	if errors.Is(err, ErrorNotFound) {
+		return &FnResult{NotFound: true}
+	}
+	if err != nil {
+		return &FnResult{Err: err}
+	}
+
+	res := &FnResult{Val: v}
+	if opt.TagsFn != nil {
+		res.Tags = opt.TagsFn(arg, v)
+	}
+	return res
+}
+
+// typedArg 取出 Typed.Do 传入的参数
+func typedArg[A any](args []interface{}) A {
+	var arg A
+	if len(args) > 0 {
+		if a, ok := args[0].(A); ok {
+			arg = a
+		}
+	}
+	return arg
+}
+
+// Do 取缓存结果，如果不存在，则更新缓存
+func (t *Typed[A, V]) Do(ctx context.Context, arg A) (V, error) {
+	var zero V
+	v, err := t.hc.Do(ctx, arg)
+	if err != nil || v == nil {
+		return zero, err
+	}
+
+	val, ok := v.(V)
+	if !ok {
+		return zero, fmt.Errorf("hacache: cached value type %T is not %T", v, zero)
+	}
+	return val, nil
+}
+
+// DoMulti 批量取缓存结果，返回值、error 与 args 一一对应
+func (t *Typed[A, V]) DoMulti(ctx context.Context, args []A) ([]V, []error) {
+	argsList := make([][]interface{}, len(args))
+	for i, arg := range args {
+		argsList[i] = []interface{}{arg}
+	}
+
+	vals := make([]V, len(args))
+	errs := make([]error, len(args))
+	results, err := t.hc.DoMulti(ctx, argsList)
+	for i := range args {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if results[i].Err != nil {
+			errs[i] = results[i].Err
+			continue
+		}
+		if results[i].Val == nil {
+			continue
+		}
+
+		val, ok := results[i].Val.(V)
+		if !ok {
+			errs[i] = fmt.Errorf("hacache: cached value type %T is not %T", results[i].Val, vals[i])
+			continue
+		}
+		vals[i] = val
+	}
+	return vals, errs
+}
+
+// Invalidate 删除 arg 对应的缓存
+func (t *Typed[A, V]) Invalidate(ctx context.Context, arg A) error {
+	return t.hc.Invalidate(ctx, arg)
+}
+
+// Delete 删除缓存
+func (t *Typed[A, V]) Delete(ctx context.Context, key string) error {
+	return t.hc.Delete(ctx, key)
+}
+
+// InvalidateTag 使所有关联了 tag 的缓存失效
+func (t *Typed[A, V]) InvalidateTag(ctx context.Context, tag string) error {
+	return t.hc.InvalidateTag(ctx, tag)
+}
+
+// Close 关闭 ha-cache，并等待已经触发的缓存更新处理完
+func (t *Typed[A, V]) Close(ctx context.Context) error {
+	return t.hc.Close(ctx)
+}
+
+// Stats 当前实例的统计数据
+func (t *Typed[A, V]) Stats() *Stats {
+	return t.hc.Stats()
+}
+
+// GenCacheKey 生成缓存 key
+func (t *Typed[A, V]) GenCacheKey(arg A) string {
+	return t.hc.GenCacheKey(context.Background(), arg)
+}
+
+// TypedEncoder 泛型 encoder，直接反序列化为 V，不需要提供 NewValueFn
+// 与 HaEncoder 一致，protobuf message 使用 protobuf 序列化，其他类型使用 msgpack
+type TypedEncoder[V any] struct{}
+
+// Encode encode v to bytes
+func (enc *TypedEncoder[V]) Encode(v interface{}) ([]byte, error) {
+	return (&HaEncoder{}).Encode(v)
+}
+
+// Decode decode bytes to V
+func (enc *TypedEncoder[V]) Decode(b []byte) (interface{}, error) {
+	v, _ := enc.NewValue().(V)
+	if msg, ok := any(v).(proto.Message); ok {
+		return v, proto.Unmarshal(b, msg)
+	}
+
+	err := msgpack.Unmarshal(b, &v)
+	return v, err
+}
+
+// NewValue return new empty V, protobuf message 会分配一个新的实例
+func (enc *TypedEncoder[V]) NewValue() interface{} {
+	var v V
+	if msg, ok := any(v).(proto.Message); ok {
+		return msg.ProtoReflect().New().Interface()
+	}
+	return v
+}
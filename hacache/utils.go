@@ -1,18 +1,29 @@
 package hacache
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"reflect"
+	"runtime/debug"
+
+	"go.uber.org/zap"
 )
 
-// call fn(args...)
-func call(fn interface{}, args ...interface{}) ([]reflect.Value, error) {
-	if reflect.TypeOf(fn).Kind() != reflect.Func {
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// call fn(args...)，fn 的第一个参数为 context.Context 时，调用 fn(ctx, args...)
+func call(fn interface{}, ctx context.Context, args ...interface{}) ([]reflect.Value, error) {
+	if fn == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
 		return nil, errors.New("invalid func")
 	}
 
 	f := reflect.ValueOf(fn)
 	numIn := f.Type().NumIn()
+	if numIn > 0 && f.Type().In(0) == contextType {
+		args = append([]interface{}{ctx}, args...)
+	}
 	if len(args) < numIn {
 		return nil, errors.New("args length not match")
 	}
@@ -25,10 +36,10 @@ func call(fn interface{}, args ...interface{}) ([]reflect.Value, error) {
 	return f.Call(in), nil
 }
 
-// copy 拷贝值，返回拷贝后的指针
+// copy 拷贝值，返回拷贝后的指针，非指针类型本身就是值拷贝，直接返回
 func copyVal(v interface{}) interface{} {
-	if reflect.TypeOf(v).Kind() != reflect.Ptr {
-		return nil
+	if v == nil || reflect.TypeOf(v).Kind() != reflect.Ptr || reflect.ValueOf(v).IsNil() {
+		return v
 	}
 
 	copied := reflect.ValueOf(v).Elem()
@@ -36,3 +47,48 @@ func copyVal(v interface{}) interface{} {
 	copiedPtr.Elem().Set(copied)
 	return copiedPtr.Interface()
 }
+
+// shard 将 key 映射到 [0, n) 中的一个分片
+func shard(key string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// copyResult 拷贝原函数执行结果，返回值使用 copyVal 拷贝
+func copyResult(res *FnResult) *FnResult {
+	copied := *res
+	copied.Val = copyVal(res.Val)
+	return &copied
+}
+
+// runWithContext 执行 fn，ctx 可取消时在单独的 goroutine 中执行，ctx 取消后不再等待，直接返回 ctx.Err()
+func runWithContext[T any](ctx context.Context, logger *zap.Logger, fn func() (T, error)) (T, error) {
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	type fnReturn struct {
+		v   T
+		err error
+	}
+	ch := make(chan fnReturn, 1)
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				logger.Error(fmt.Sprintf("hacache fn paniced: %v, stack: %s", v, string(debug.Stack())))
+				ch <- fnReturn{err: fmt.Errorf("hacache fn paniced: %v", v)}
+			}
+		}()
+		v, err := fn()
+		ch <- fnReturn{v: v, err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.v, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
@@ -1,11 +1,20 @@
 package limiter
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+
+	"github.com/xiachufang/pkg/v2/metrics"
+)
 
 // Limiter 并发限制
 type Limiter struct {
 	Current        int32
 	MaxConcurrency int32
+
+	// Name 上报指标时的 name tag
+	Name string
+	// Sink 指标上报，为 nil 时不上报
+	Sink metrics.Sink
 }
 
 // New create a concurrency limiter with MaxConcurrency=maxConcurrency
@@ -15,6 +24,15 @@ func New(maxConcurrency int32) *Limiter {
 	}
 }
 
+// NewWithSink create a concurrency limiter which reports current concurrency and rejections to sink
+func NewWithSink(maxConcurrency int32, name string, sink metrics.Sink) *Limiter {
+	return &Limiter{
+		MaxConcurrency: maxConcurrency,
+		Name:           name,
+		Sink:           sink,
+	}
+}
+
 // Incr increase current concurrency, if (-1, false) returned, reject request.
 func (limiter *Limiter) Incr(v int32) (int32, bool) {
 	if limiter.MaxConcurrency <= 0 {
@@ -22,7 +40,11 @@ func (limiter *Limiter) Incr(v int32) (int32, bool) {
 	}
 
 	current := atomic.AddInt32(&limiter.Current, v)
+	limiter.gauge(current)
 	if current > limiter.MaxConcurrency {
+		if limiter.Sink != nil {
+			limiter.Sink.Incr("limiter-rejected", 1, metrics.T("name", limiter.Name))
+		}
 		return -1, false
 	}
 
@@ -35,10 +57,19 @@ func (limiter *Limiter) Decr(v int32) (int32, bool) {
 		return 0, true
 	}
 
-	return atomic.AddInt32(&limiter.Current, -v), true
+	current := atomic.AddInt32(&limiter.Current, -v)
+	limiter.gauge(current)
+	return current, true
 }
 
 // GetCurrent get current concurrency
 func (limiter *Limiter) GetCurrent() int32 {
 	return atomic.LoadInt32(&limiter.Current)
 }
+
+// gauge 上报当前并发度
+func (limiter *Limiter) gauge(current int32) {
+	if limiter.Sink != nil {
+		limiter.Sink.Gauge("limiter-concurrency", int64(current), metrics.T("name", limiter.Name))
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/xiachufang/pkg/v2/metrics"
 )
 
 func TestLimiter(t *testing.T) {
@@ -50,3 +52,25 @@ func TestConcurrency(t *testing.T) {
 		t.Fatalf("expect concurrent run nums: %d, got: %d\n", maxConcurrency, hitTimes)
 	}
 }
+
+func TestLimiterSink(t *testing.T) {
+	sink := metrics.NewMemorySink()
+	limiter := NewWithSink(1, "task", sink)
+	tag := metrics.T("name", "task")
+
+	limiter.Incr(1)
+	if v := sink.GaugeValue("limiter-concurrency", tag); v != 1 {
+		t.Fatal("expect concurrency 1, got: ", v)
+	}
+	if _, ok := limiter.Incr(1); ok {
+		t.Fatal("expect rejected")
+	}
+	if v := sink.Counter("limiter-rejected", tag); v != 1 {
+		t.Fatal("expect rejected 1, got: ", v)
+	}
+
+	limiter.Decr(2)
+	if v := sink.GaugeValue("limiter-concurrency", tag); v != 0 {
+		t.Fatal("expect concurrency 0, got: ", v)
+	}
+}
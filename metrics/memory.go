@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemorySink 在内存中记录指标，一般用于测试或者进程内查看
+type MemorySink struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]int64
+	timings  map[string][]time.Duration
+}
+
+// NewMemorySink 创建内存指标
+func NewMemorySink() *MemorySink {
+	return &MemorySink{
+		counters: make(map[string]int64),
+		gauges:   make(map[string]int64),
+		timings:  make(map[string][]time.Duration),
+	}
+}
+
+// Incr implements Sink
+func (s *MemorySink) Incr(name string, value int64, tags ...Tag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[seriesKey(name, tags)] += value
+}
+
+// Gauge implements Sink
+func (s *MemorySink) Gauge(name string, value int64, tags ...Tag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gauges[seriesKey(name, tags)] = value
+}
+
+// Timing implements Sink
+func (s *MemorySink) Timing(name string, d time.Duration, tags ...Tag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := seriesKey(name, tags)
+	s.timings[key] = append(s.timings[key], d)
+}
+
+// Counter 计数器的累计值，tags 与上报时一致（顺序无关）
+func (s *MemorySink) Counter(name string, tags ...Tag) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[seriesKey(name, tags)]
+}
+
+// GaugeValue gauge 的当前值
+func (s *MemorySink) GaugeValue(name string, tags ...Tag) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gauges[seriesKey(name, tags)]
+}
+
+// Timings 记录的所有耗时
+func (s *MemorySink) Timings(name string, tags ...Tag) []time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Duration(nil), s.timings[seriesKey(name, tags)]...)
+}
+
+// Reset 清空所有指标
+func (s *MemorySink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters = make(map[string]int64)
+	s.gauges = make(map[string]int64)
+	s.timings = make(map[string][]time.Duration)
+}
+
+// seriesKey 指标名称与排序后的 tags 组成的 key
+func seriesKey(name string, tags []Tag) string {
+	pairs := make([]string, len(tags))
+	for i, tag := range tags {
+		pairs[i] = tag.Key + "=" + tag.Value
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import "time"
+
+// Tag 指标 tag
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// T 创建 tag
+func T(key, value string) Tag {
+	return Tag{Key: key, Value: value}
+}
+
+// Sink 指标上报接口，实现需要支持并发调用
+type Sink interface {
+	// Incr 计数器增加 value
+	Incr(name string, value int64, tags ...Tag)
+	// Gauge 设置 gauge 当前值
+	Gauge(name string, value int64, tags ...Tag)
+	// Timing 记录一次耗时
+	Timing(name string, d time.Duration, tags ...Tag)
+}
+
+// NopSink 丢弃所有指标
+type NopSink struct{}
+
+// Incr implements Sink
+func (NopSink) Incr(name string, value int64, tags ...Tag) {}
+
+// Gauge implements Sink
+func (NopSink) Gauge(name string, value int64, tags ...Tag) {}
+
+// Timing implements Sink
+func (NopSink) Timing(name string, d time.Duration, tags ...Tag) {}
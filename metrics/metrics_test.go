@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySink(t *testing.T) {
+	sink := NewMemorySink()
+	sink.Incr("hit", 1, T("name", "foo"), T("m", "a"))
+	sink.Incr("hit", 2, T("m", "a"), T("name", "foo"))
+	sink.Incr("hit", 1, T("name", "bar"))
+	sink.Gauge("concurrency", 3)
+	sink.Gauge("concurrency", 2)
+	sink.Timing("latency", time.Second)
+
+	// tag 顺序无关
+	if v := sink.Counter("hit", T("m", "a"), T("name", "foo")); v != 3 {
+		t.Fatal("expect counter 3, got: ", v)
+	}
+	if v := sink.Counter("hit", T("name", "bar")); v != 1 {
+		t.Fatal("expect counter 1, got: ", v)
+	}
+	if v := sink.GaugeValue("concurrency"); v != 2 {
+		t.Fatal("expect gauge 2, got: ", v)
+	}
+	if v := sink.Timings("latency"); len(v) != 1 || v[0] != time.Second {
+		t.Fatal("unexpected timings: ", v)
+	}
+
+	sink.Reset()
+	if v := sink.Counter("hit", T("name", "bar")); v != 0 {
+		t.Fatal("expect counter reset, got: ", v)
+	}
+}
+
+func TestNopSink(t *testing.T) {
+	var sink Sink = NopSink{}
+	sink.Incr("hit", 1)
+	sink.Gauge("concurrency", 1)
+	sink.Timing("latency", time.Second)
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/smira/go-statsd"
+)
+
+// StatsdSink 通过 statsd 上报指标
+type StatsdSink struct {
+	client *statsd.Client
+}
+
+// NewStatsdSink 创建 statsd 指标上报
+func NewStatsdSink(client *statsd.Client) *StatsdSink {
+	return &StatsdSink{client: client}
+}
+
+// Incr implements Sink
+func (s *StatsdSink) Incr(name string, value int64, tags ...Tag) {
+	s.client.Incr(name, value, statsdTags(tags)...)
+}
+
+// Gauge implements Sink
+func (s *StatsdSink) Gauge(name string, value int64, tags ...Tag) {
+	s.client.Gauge(name, value, statsdTags(tags)...)
+}
+
+// Timing implements Sink
+func (s *StatsdSink) Timing(name string, d time.Duration, tags ...Tag) {
+	s.client.PrecisionTiming(name, d, statsdTags(tags)...)
+}
+
+// statsdTags 转换为 statsd tag
+func statsdTags(tags []Tag) []statsd.Tag {
+	if len(tags) == 0 {
+		return nil
+	}
+	st := make([]statsd.Tag, len(tags))
+	for i, tag := range tags {
+		st[i] = statsd.StringTag(tag.Key, tag.Value)
+	}
+	return st
+}